@@ -0,0 +1,123 @@
+package henn
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// ReLU returns ActivationLayer that approximates ReLU on [a, b],
+// with Chebyshev interpolant of degree.
+func ReLU(a, b float64, degree int) (ActivationLayer, error) {
+	return ChebyshevActivation("relu", func(x float64) float64 {
+		return math.Max(x, 0)
+	}, a, b, degree)
+}
+
+// Sigmoid returns ActivationLayer that approximates sigmoid on [a, b],
+// with Chebyshev interpolant of degree.
+func Sigmoid(a, b float64, degree int) (ActivationLayer, error) {
+	return ChebyshevActivation("sigmoid", func(x float64) float64 {
+		return 1 / (1 + math.Exp(-x))
+	}, a, b, degree)
+}
+
+// Tanh returns ActivationLayer that approximates tanh on [a, b],
+// with Chebyshev interpolant of degree.
+func Tanh(a, b float64, degree int) (ActivationLayer, error) {
+	return ChebyshevActivation("tanh", math.Tanh, a, b, degree)
+}
+
+// GELU returns ActivationLayer that approximates GELU on [a, b],
+// with Chebyshev interpolant of degree.
+func GELU(a, b float64, degree int) (ActivationLayer, error) {
+	return ChebyshevActivation("gelu", func(x float64) float64 {
+		return 0.5 * x * (1 + math.Erf(x/math.Sqrt2))
+	}, a, b, degree)
+}
+
+// ChebyshevActivation returns ActivationLayer that approximates f on [a, b],
+// with Chebyshev interpolant of degree, which should be at least 2.
+// Inputs outside of [a, b] can give arbitrary outputs,
+// so the interval should cover every input of this layer.
+//
+// The input is first mapped to [-1, 1], which consumes one level unless [a, b] = [-1, 1].
+// Then the polynomial is evaluated with ckks.Evaluator.EvaluatePoly,
+// which consumes ceil(log2(degree+1)) levels.
+// Depth of the returned layer is the sum of them.
+//
+// Name of the returned layer is "name[a,b;degree]".
+// It should be registered with RegisterActivation to serialize HENeuralNet.
+// PlaintextFn evaluates the interpolant, not f,
+// so that PlainNeuralNet matches the output of HENeuralNet.
+func ChebyshevActivation(name string, f func(float64) float64, a, b float64, degree int) (ActivationLayer, error) {
+	if !(a < b) || math.IsInf(a, 0) || math.IsInf(b, 0) {
+		return ActivationLayer{}, fmt.Errorf("%w: invalid interval [%v, %v]", ErrUnsupportedLayer, a, b)
+	}
+	// EvaluatePoly does not support linear polynomials.
+	if degree < 2 {
+		return ActivationLayer{}, fmt.Errorf("%w: invalid degree %d", ErrUnsupportedLayer, degree)
+	}
+
+	poly := ckks.Approximate(f, a, b, degree)
+	changeVariable := a != -1 || b != 1
+
+	depth := poly.Depth()
+	if changeVariable {
+		depth++
+	}
+
+	coeffs := make([]float64, len(poly.Coeffs))
+	for i, c := range poly.Coeffs {
+		coeffs[i] = real(c)
+	}
+
+	return ActivationLayer{
+		Name: fmt.Sprintf("%s[%v,%v;%d]", name, a, b, degree),
+		ActivationFn: func(nn *HENeuralNet, ct *rlwe.Ciphertext) error {
+			if changeVariable {
+				// x -> (2x - a - b) / (b - a)
+				// Multiply by plaintext at the scale of the current modulus,
+				// so that it always consumes one level, even for integer constants.
+				slope := make([]float64, nn.Parameters.Slots())
+				for i := range slope {
+					slope[i] = 2 / (b - a)
+				}
+				pt := nn.Encoder.EncodeNew(slope, ct.Level(), rlwe.NewScale(nn.Parameters.QiFloat64(ct.Level())), nn.Parameters.LogSlots())
+				nn.Evaluator.Mul(ct, pt, ct)
+				nn.Evaluator.AddConst(ct, (-a-b)/(b-a), ct)
+				if err := nn.Rescale(ct); err != nil {
+					return err
+				}
+			}
+
+			if ct.Level() < poly.Depth() {
+				return ErrInsufficientLevels
+			}
+			ctOut, err := nn.Evaluator.EvaluatePoly(ct, poly, ct.Scale)
+			if err != nil {
+				return err
+			}
+			ct.Resize(ctOut.Degree(), ctOut.Level())
+			ct.Copy(ctOut)
+			return nil
+		},
+		PlaintextFn: func(x float64) float64 {
+			return evaluateChebyshev(coeffs, (2*x-a-b)/(b-a))
+		},
+		Depth: depth,
+	}, nil
+}
+
+// evaluateChebyshev evaluates sum coeffs[i] * T_i(y).
+func evaluateChebyshev(coeffs []float64, y float64) float64 {
+	Tprev, T := 1.0, y
+	v := coeffs[0]
+	for _, c := range coeffs[1:] {
+		v += c * T
+		Tprev, T = T, 2*y*T-Tprev
+	}
+	return v
+}
@@ -0,0 +1,270 @@
+package henn
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// bundleMagic is written at the start of every serialized PublicKeyBundle.
+var bundleMagic = []byte("HENK")
+
+// bundleVersion is the version of the PublicKeyBundle serialization format.
+const bundleVersion = 1
+
+// Tags for serialized keys in PublicKeyBundle.
+const (
+	tagPublicKey byte = iota + 1
+	tagRelinearizationKey
+	tagRotationKeys
+	// Keys in the seeded format of ClientContext.MarshalSeededBundle.
+	tagSeededRelinearizationKey
+	tagSeededRotationKeys
+)
+
+// PublicKeyBundle contains everything the server needs from the client,
+// which is parameters, public key, relinearization key and rotation keys.
+// It never contains any secret material, so it is safe to send it to the server.
+type PublicKeyBundle struct {
+	Parameters ckks.Parameters
+
+	PublicKey          *rlwe.PublicKey
+	RelinearizationKey *rlwe.RelinearizationKey
+	RotationKeys       *rlwe.RotationKeySet
+}
+
+// EvaluationKey returns the evaluation key of this bundle.
+func (b *PublicKeyBundle) EvaluationKey() rlwe.EvaluationKey {
+	return rlwe.EvaluationKey{Rlk: b.RelinearizationKey, Rtks: b.RotationKeys}
+}
+
+// Validate checks if this bundle is well-formed:
+// parameters are set, relinearization key exists,
+// and every key has the correct dimension for the parameters.
+func (b *PublicKeyBundle) Validate() error {
+	if b.Parameters.LogN() == 0 {
+		return fmt.Errorf("%w: empty parameters", ErrInvalidKeys)
+	}
+	if b.RelinearizationKey == nil {
+		return fmt.Errorf("%w: missing relinearization key", ErrInvalidKeys)
+	}
+
+	if b.PublicKey != nil {
+		for _, p := range b.PublicKey.Value {
+			if !b.checkPoly(p.Q) || !b.checkPoly(p.P) {
+				return fmt.Errorf("%w: invalid public key", ErrInvalidKeys)
+			}
+		}
+	}
+	for _, swk := range b.RelinearizationKey.Keys {
+		if !b.checkSwitchingKey(swk) {
+			return fmt.Errorf("%w: invalid relinearization key", ErrInvalidKeys)
+		}
+	}
+	if b.RotationKeys != nil {
+		for galEl, swk := range b.RotationKeys.Keys {
+			if !b.checkSwitchingKey(swk) {
+				return fmt.Errorf("%w: invalid rotation key for galois element %d", ErrInvalidKeys, galEl)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkSwitchingKey checks if swk has correct dimension.
+func (b *PublicKeyBundle) checkSwitchingKey(swk *rlwe.SwitchingKey) bool {
+	if swk == nil || len(swk.Value) == 0 {
+		return false
+	}
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			for _, p := range swk.Value[i][j].Value {
+				if !b.checkPoly(p.Q) || !b.checkPoly(p.P) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// checkPoly checks if p has correct degree.
+// nil polynomial is allowed, since P may be absent.
+func (b *PublicKeyBundle) checkPoly(p *ring.Poly) bool {
+	return p == nil || p.N() == b.Parameters.N()
+}
+
+// CheckBundle checks that b is generated from this context,
+// and that it does not contain the secret key of this context.
+// Clients can call this before sending the bundle to the server.
+func (ctx *ClientContext) CheckBundle(b *PublicKeyBundle) error {
+	if !b.Parameters.Equals(ctx.Parameters) {
+		return ErrParametersMismatch
+	}
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	isSecret := func(p *ring.Poly) bool {
+		sk := ctx.SecretKey.Value
+		return (sk.Q != nil && p != nil && sk.Q.Equals(p)) || (sk.P != nil && p != nil && sk.P.Equals(p))
+	}
+	checkSwitchingKey := func(swk *rlwe.SwitchingKey) bool {
+		for i := range swk.Value {
+			for j := range swk.Value[i] {
+				for _, p := range swk.Value[i][j].Value {
+					if isSecret(p.Q) || isSecret(p.P) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+
+	if b.PublicKey != nil {
+		for _, p := range b.PublicKey.Value {
+			if isSecret(p.Q) || isSecret(p.P) {
+				return fmt.Errorf("%w: public key contains secret key", ErrInvalidKeys)
+			}
+		}
+	}
+	for _, swk := range b.RelinearizationKey.Keys {
+		if checkSwitchingKey(swk) {
+			return fmt.Errorf("%w: relinearization key contains secret key", ErrInvalidKeys)
+		}
+	}
+	if b.RotationKeys != nil {
+		for _, swk := range b.RotationKeys.Keys {
+			if checkSwitchingKey(swk) {
+				return fmt.Errorf("%w: rotation key contains secret key", ErrInvalidKeys)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes this bundle to bytes.
+// Use ClientContext.MarshalSeededBundle for the smaller seeded format.
+func (b *PublicKeyBundle) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeBundleHeader(buf, b.Parameters, b.PublicKey); err != nil {
+		return nil, err
+	}
+
+	if b.RelinearizationKey != nil {
+		rlkBytes, err := b.RelinearizationKey.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(tagRelinearizationKey)
+		writeBytes(buf, rlkBytes)
+	}
+
+	if b.RotationKeys != nil {
+		rtksBytes, err := b.RotationKeys.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(tagRotationKeys)
+		writeBytes(buf, rtksBytes)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeBundleHeader writes the header, parameters and public key of the bundle to buf.
+// pk may be nil.
+func writeBundleHeader(buf *bytes.Buffer, params ckks.Parameters, pk *rlwe.PublicKey) error {
+	buf.Write(bundleMagic)
+	buf.WriteByte(bundleVersion)
+
+	paramsBytes, err := params.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	writeBytes(buf, paramsBytes)
+
+	if pk != nil {
+		pkBytes, err := pk.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(tagPublicKey)
+		writeBytes(buf, pkBytes)
+	}
+	return nil
+}
+
+// UnmarshalBinary decodes bytes to this bundle.
+// Both formats of MarshalBinary and ClientContext.MarshalSeededBundle are accepted,
+// and seeded keys are expanded here.
+// Only public keys are accepted: any unknown section is rejected.
+func (b *PublicKeyBundle) UnmarshalBinary(data []byte) (err error) {
+	defer recoverError(&err, ErrInvalidEncoding)
+
+	if len(data) < len(bundleMagic)+1 || !bytes.Equal(data[:len(bundleMagic)], bundleMagic) {
+		return fmt.Errorf("%w: invalid header", ErrInvalidEncoding)
+	}
+	if v := data[len(bundleMagic)]; v != bundleVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, v)
+	}
+
+	d := &decoder{data: data[len(bundleMagic)+1:]}
+
+	var params ckks.Parameters
+	paramsBytes := d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if err := params.UnmarshalBinary(paramsBytes); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+
+	bundle := PublicKeyBundle{Parameters: params}
+	for len(d.data) > 0 {
+		tag := d.byte()
+		keyBytes := d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+
+		var err error
+		switch tag {
+		case tagPublicKey:
+			bundle.PublicKey = new(rlwe.PublicKey)
+			err = bundle.PublicKey.UnmarshalBinary(keyBytes)
+		case tagRelinearizationKey:
+			bundle.RelinearizationKey = new(rlwe.RelinearizationKey)
+			err = bundle.RelinearizationKey.UnmarshalBinary(keyBytes)
+		case tagRotationKeys:
+			bundle.RotationKeys = new(rlwe.RotationKeySet)
+			err = bundle.RotationKeys.UnmarshalBinary(keyBytes)
+		case tagSeededRelinearizationKey:
+			sd := &decoder{data: keyBytes}
+			bundle.RelinearizationKey = sd.seededRelinearizationKey(params)
+			if err := sd.close(); err != nil {
+				return err
+			}
+		case tagSeededRotationKeys:
+			sd := &decoder{data: keyBytes}
+			bundle.RotationKeys = sd.seededRotationKeys(params)
+			if err := sd.close(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unknown key tag %d", ErrInvalidEncoding, tag)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+		}
+	}
+
+	*b = bundle
+	return nil
+}
@@ -0,0 +1,165 @@
+package henn
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// ClientContext contains various structures for CKKS operations for clients,
+// such as Encoder, Encryptor, Decryptor, and KeyGenerator.
+// It owns the secret key, so it should never leave the client.
+// Its EncryptionContext encrypts with the secret key.
+// Use PublicKeyBundle to obtain keys to send to the server.
+type ClientContext struct {
+	*EncryptionContext
+
+	Decryptor rlwe.Decryptor
+
+	KeyGenerator       rlwe.KeyGenerator
+	PublicKey          *rlwe.PublicKey
+	SecretKey          *rlwe.SecretKey
+	RelinearizationKey *rlwe.RelinearizationKey
+	RotationKeys       *rlwe.RotationKeySet
+}
+
+// CKKSContext is an alias of ClientContext.
+//
+// Deprecated: Use ClientContext instead.
+type CKKSContext = ClientContext
+
+// NewClientContext creates a new ClientContext.
+// This DOES NOT create rotation keys. Use GenRotationKeys instaed.
+func NewClientContext(params ckks.Parameters) *ClientContext {
+	keyGenerator := ckks.NewKeyGenerator(params)
+	sk, pk := keyGenerator.GenKeyPair()
+	rlk := keyGenerator.GenRelinearizationKey(sk, relinearizationDegree)
+
+	encoder := ckks.NewEncoder(params)
+	encryptor := ckks.NewEncryptor(params, sk)
+	decryptor := ckks.NewDecryptor(params, sk)
+
+	return &ClientContext{
+		EncryptionContext: &EncryptionContext{
+			Parameters: params,
+			Encoder:    encoder,
+			Encryptor:  encryptor,
+		},
+
+		Decryptor: decryptor,
+
+		KeyGenerator:       keyGenerator,
+		PublicKey:          pk,
+		SecretKey:          sk,
+		RelinearizationKey: rlk,
+	}
+}
+
+// NewCKKSContext creates a new ClientContext.
+//
+// Deprecated: Use NewClientContext instead.
+func NewCKKSContext(params ckks.Parameters) *ClientContext {
+	return NewClientContext(params)
+}
+
+// GenRotationKeys creates rotation keys and stores them internally.
+func (ctx *ClientContext) GenRotationKeys(rots []int) {
+	ctx.RotationKeys = ctx.KeyGenerator.GenRotationKeysForRotations(rots, false, ctx.SecretKey)
+}
+
+// PublicEncryptor returns the EncryptionContext using the public key of this context.
+// It can be handed to third parties, since it does not contain the secret key.
+func (ctx *ClientContext) PublicEncryptor() *EncryptionContext {
+	return NewPublicEncryptor(ctx.Parameters, ctx.PublicKey)
+}
+
+// PublicKeyBundle returns the PublicKeyBundle of this context,
+// which can be safely sent to the server.
+func (ctx *ClientContext) PublicKeyBundle() *PublicKeyBundle {
+	return &PublicKeyBundle{
+		Parameters:         ctx.Parameters,
+		PublicKey:          ctx.PublicKey,
+		RelinearizationKey: ctx.RelinearizationKey,
+		RotationKeys:       ctx.RotationKeys,
+	}
+}
+
+// DecryptInts decrypts and decodes encryption of slices of ints.
+func (ctx *ClientContext) DecryptInts(ct *rlwe.Ciphertext, len int) ([]int, error) {
+	msgFloats, err := ctx.DecryptFloats(ct, len)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]int, len)
+	for i := range msg {
+		msg[i] = int(math.Round(msgFloats[i]))
+	}
+	return msg, nil
+}
+
+// DecryptFloats decrypts and decodes encryption of slices of float64s.
+func (ctx *ClientContext) DecryptFloats(ct *rlwe.Ciphertext, len int) ([]float64, error) {
+	if len < 0 || len > ctx.Parameters.Slots() {
+		return nil, fmt.Errorf("%w: cannot decrypt %d values from %d slots", ErrShapeMismatch, len, ctx.Parameters.Slots())
+	}
+
+	pt := ctx.Decryptor.DecryptNew(ct)
+	msgCmplx := ctx.Encoder.Decode(pt, ctx.Parameters.LogSlots())
+	msg := make([]float64, len)
+	for i := range msg {
+		msg[i] = real(msgCmplx[i])
+	}
+	return msg, nil
+}
+
+// DecryptFloatsVector decrypts and decodes encryption of slices of float64s in multiple ciphertexts,
+// which is the output of HENeuralNet.InferVector.
+// It returns the first n values of the concatenation of cts.
+func (ctx *ClientContext) DecryptFloatsVector(cts []*rlwe.Ciphertext, n int) ([]float64, error) {
+	slots := ctx.Parameters.Slots()
+	if n < 0 || n > len(cts)*slots {
+		return nil, fmt.Errorf("%w: cannot decrypt %d values from %d ciphertexts", ErrShapeMismatch, n, len(cts))
+	}
+
+	msg := make([]float64, 0, n)
+	for _, ct := range cts {
+		if len(msg) == n {
+			break
+		}
+		m := slots
+		if n-len(msg) < m {
+			m = n - len(msg)
+		}
+		msgCt, err := ctx.DecryptFloats(ct, m)
+		if err != nil {
+			return nil, err
+		}
+		msg = append(msg, msgCt...)
+	}
+	return msg, nil
+}
+
+// DecryptFloatsBatch decrypts and decodes the output of batched HENeuralNet.
+// It returns len values of each of batch blocks.
+func (ctx *ClientContext) DecryptFloatsBatch(ct *rlwe.Ciphertext, batch int, len int) ([][]float64, error) {
+	if batch <= 0 || ctx.Parameters.Slots()%batch != 0 {
+		return nil, fmt.Errorf("%w: invalid batch %d", ErrShapeMismatch, batch)
+	}
+	block := ctx.Parameters.Slots() / batch
+	if len < 0 || len > block {
+		return nil, fmt.Errorf("%w: cannot decrypt %d values from %d slots", ErrShapeMismatch, len, block)
+	}
+
+	msg, err := ctx.DecryptFloats(ct, ctx.Parameters.Slots())
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([][]float64, batch)
+	for i := range msgs {
+		msgs[i] = msg[i*block : i*block+len]
+	}
+	return msgs, nil
+}
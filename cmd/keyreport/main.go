@@ -0,0 +1,60 @@
+// Command keyreport reports the size of evaluation keys a client uploads to serve a model.
+//
+// Usage:
+//
+//	keyreport [-model path] [-pow2]
+//
+// The model is a HENeuralNet serialized with MarshalBinary.
+// If -model is not given, the pre-trained MNIST model of hemnist is used.
+// With -pow2, keys are restricted to power-of-two rotations, as HENeuralNet.PowerOfTwoRotations.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"henn"
+	"henn/hemnist"
+	"os"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+)
+
+func main() {
+	modelPath := flag.String("model", "", "path to the serialized HENeuralNet (default: hemnist model)")
+	pow2 := flag.Bool("pow2", false, "restrict rotation keys to power-of-two rotations")
+	flag.Parse()
+
+	model, err := loadModel(*modelPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "keyreport:", err)
+		os.Exit(1)
+	}
+	model.PowerOfTwoRotations = *pow2
+
+	fmt.Printf("Parameters:          LogN %d, LogQP %d, Slots %d\n", model.Parameters.LogN(), model.Parameters.LogQP(), model.Parameters.Slots())
+	fmt.Print(henn.NewKeyReport(model.Parameters, model.Rotations()))
+
+	full, powerOfTwo := model.RotationTradeoff()
+	fmt.Printf("Key switches:        %d (all rotation keys), %d (power-of-two keys)\n", full.KeySwitches, powerOfTwo.KeySwitches)
+}
+
+// loadModel reads the model from path, or returns the hemnist model if path is empty.
+func loadModel(path string) (*henn.HENeuralNet, error) {
+	if path == "" {
+		params, err := ckks.NewParametersFromLiteral(hemnist.DefaultParams)
+		if err != nil {
+			return nil, err
+		}
+		return henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	model := new(henn.HENeuralNet)
+	if err := model.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
@@ -0,0 +1,175 @@
+package henn
+
+import (
+	"fmt"
+)
+
+// Padding represents zero padding of the input of convolution.
+// If Same is true, other fields are ignored,
+// and the input is padded so that the output size is ceil(input size / stride).
+// As in TensorFlow, extra padding goes to the bottom and right.
+type Padding struct {
+	Top    int
+	Bottom int
+	Left   int
+	Right  int
+
+	Same bool
+}
+
+// SamePadding is the Padding for "same" convolution.
+var SamePadding = Padding{Same: true}
+
+// ConvSpec represents the geometry of the convolution:
+// input size, kernel size, strides and padding.
+// It is shared by Im2Col encoding on the client and ConvLayer on the server,
+// so that the encoded input always matches the kernel layout.
+//
+// Rows are along X, and columns are along Y.
+type ConvSpec struct {
+	InputX int
+	InputY int
+
+	KernelX int
+	KernelY int
+
+	StrideX int
+	StrideY int
+
+	Padding Padding
+}
+
+// NewConvSpec returns ConvSpec with square kernel and equal strides, without padding.
+func NewConvSpec(inputX, inputY, kernelSize, stride int) ConvSpec {
+	return ConvSpec{
+		InputX:  inputX,
+		InputY:  inputY,
+		KernelX: kernelSize,
+		KernelY: kernelSize,
+		StrideX: stride,
+		StrideY: stride,
+	}
+}
+
+// pads returns the padding of each side, which is (top, bottom, left, right).
+func (s ConvSpec) pads() (int, int, int, int) {
+	if !s.Padding.Same {
+		return s.Padding.Top, s.Padding.Bottom, s.Padding.Left, s.Padding.Right
+	}
+
+	same := func(input, kernel, stride int) (int, int) {
+		output := (input + stride - 1) / stride
+		pad := (output-1)*stride + kernel - input
+		if pad < 0 {
+			pad = 0
+		}
+		return pad / 2, pad - pad/2
+	}
+	top, bottom := same(s.InputX, s.KernelX, s.StrideX)
+	left, right := same(s.InputY, s.KernelY, s.StrideY)
+	return top, bottom, left, right
+}
+
+// OutputSize returns the size of a feature map after convolution, which is (X, Y).
+// Remaining rows and columns that do not fill a whole window are dropped.
+func (s ConvSpec) OutputSize() (int, int) {
+	top, bottom, left, right := s.pads()
+	return (s.InputX+top+bottom-s.KernelX)/s.StrideX + 1, (s.InputY+left+right-s.KernelY)/s.StrideY + 1
+}
+
+// check checks if this ConvSpec is valid.
+func (s ConvSpec) check() error {
+	if s.KernelX <= 0 || s.KernelY <= 0 || s.StrideX <= 0 || s.StrideY <= 0 {
+		return fmt.Errorf("%w: invalid kernel size %d*%d with stride %d*%d", ErrShapeMismatch, s.KernelX, s.KernelY, s.StrideX, s.StrideY)
+	}
+
+	top, bottom, left, right := s.pads()
+	if top < 0 || bottom < 0 || left < 0 || right < 0 {
+		return fmt.Errorf("%w: negative padding", ErrShapeMismatch)
+	}
+	if s.InputX <= 0 || s.InputY <= 0 || s.InputX+top+bottom < s.KernelX || s.InputY+left+right < s.KernelY {
+		return fmt.Errorf("%w: input size %d*%d does not fit kernel size %d*%d", ErrShapeMismatch, s.InputX, s.InputY, s.KernelX, s.KernelY)
+	}
+
+	return nil
+}
+
+// inputIndex returns the row-major index of (i, j) of the padded image in the input,
+// or false if it is in the padding.
+func (s ConvSpec) inputIndex(i, j int) (int, bool) {
+	top, _, left, _ := s.pads()
+	i, j = i-top, j-left
+	if i < 0 || i >= s.InputX || j < 0 || j >= s.InputY {
+		return 0, false
+	}
+	return i*s.InputY + j, true
+}
+
+// input returns the value of img at (i, j) of the padded image,
+// which is zero if it is in the padding.
+func (s ConvSpec) input(img [][]float64, i, j int) float64 {
+	idx, ok := s.inputIndex(i, j)
+	if !ok {
+		return 0
+	}
+	return img[idx/s.InputY][idx%s.InputY]
+}
+
+// Im2Col encodes an image with multiple channels(3D slice) as column form, and flattens it.
+// img has shape (channels, InputX, InputY).
+//
+// Im2Col encoding of each channel is concatenated,
+// so that ConvLayer sums across input channels.
+func (s ConvSpec) Im2Col(img [][][]float64) ([]float64, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	if len(img) == 0 {
+		return nil, fmt.Errorf("%w: empty image", ErrShapeMismatch)
+	}
+	for _, ch := range img {
+		if len(ch) != s.InputX {
+			return nil, fmt.Errorf("%w: image size does not match input size %d*%d", ErrShapeMismatch, s.InputX, s.InputY)
+		}
+		for _, row := range ch {
+			if len(row) != s.InputY {
+				return nil, fmt.Errorf("%w: image size does not match input size %d*%d", ErrShapeMismatch, s.InputX, s.InputY)
+			}
+		}
+	}
+
+	outX, outY := s.OutputSize()
+	XX := s.KernelX * s.KernelY
+	YY := outX * outY
+
+	flattened := make([]float64, 0, len(img)*XX*YY)
+	for _, ch := range img {
+		encodedImg := make([][]float64, XX)
+		for i := range encodedImg {
+			encodedImg[i] = make([]float64, YY)
+		}
+
+		// Im2Col
+		var xx, yy int
+		for i := 0; i < outX; i++ {
+			for j := 0; j < outY; j++ {
+				for ki := 0; ki < s.KernelX; ki++ {
+					for kj := 0; kj < s.KernelY; kj++ {
+						encodedImg[xx][yy] = s.input(ch, i*s.StrideX+ki, j*s.StrideY+kj)
+						xx++
+					}
+				}
+				xx, yy = 0, yy+1
+			}
+		}
+
+		// Flatten by vertical scanning
+		// NOTE: It's already vertically aligned after Im2Col,
+		// so we can just append everything
+		for _, row := range encodedImg {
+			flattened = append(flattened, row...)
+		}
+	}
+
+	return flattened, nil
+}
@@ -0,0 +1,159 @@
+package henn
+
+import (
+	"fmt"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// EncryptionContext contains structures needed to encrypt inputs of HENeuralNet,
+// which is Encoder and Encryptor.
+// It is embedded in ClientContext, where Encryptor uses the secret key.
+// EncryptionContext created by NewPublicEncryptor uses the public key,
+// so that anyone without the secret key can encrypt inputs.
+type EncryptionContext struct {
+	Parameters ckks.Parameters
+
+	Encoder   ckks.Encoder
+	Encryptor rlwe.Encryptor
+}
+
+// NewPublicEncryptor creates a new EncryptionContext that encrypts with public key pk.
+// Ciphertexts encrypted with it can only be decrypted by the owner of the corresponding secret key.
+func NewPublicEncryptor(params ckks.Parameters, pk *rlwe.PublicKey) *EncryptionContext {
+	return &EncryptionContext{
+		Parameters: params,
+		Encoder:    ckks.NewEncoder(params),
+		Encryptor:  ckks.NewEncryptor(params, pk),
+	}
+}
+
+// EncryptInts encodes and encrypts slices of int to ckks ciphertext.
+func (ctx *EncryptionContext) EncryptInts(msg []int) (*rlwe.Ciphertext, error) {
+	msgFloats := make([]float64, len(msg))
+	for i, v := range msg {
+		msgFloats[i] = float64(v)
+	}
+	return ctx.EncryptFloats(msgFloats)
+}
+
+// EncryptFloats encodes and encrypts slices of float64s to ckks ciphertext.
+func (ctx *EncryptionContext) EncryptFloats(msg []float64) (*rlwe.Ciphertext, error) {
+	if len(msg) > ctx.Parameters.Slots() {
+		return nil, fmt.Errorf("%w: message of length %d does not fit in %d slots", ErrShapeMismatch, len(msg), ctx.Parameters.Slots())
+	}
+
+	pt := ctx.Encoder.EncodeNew(msg, ctx.Parameters.MaxLevel(), ctx.Parameters.DefaultScale(), ctx.Parameters.LogSlots())
+	return ctx.Encryptor.EncryptNew(pt), nil
+}
+
+// EncryptFloatsVector encrypts msg in multiple ciphertexts,
+// where ciphertext i has the values from i * Slots.
+// This is the input of HENeuralNet.InferVector, when the input does not fit in one ciphertext.
+func (ctx *EncryptionContext) EncryptFloatsVector(msg []float64) ([]*rlwe.Ciphertext, error) {
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("%w: empty message", ErrShapeMismatch)
+	}
+
+	slots := ctx.Parameters.Slots()
+	cts := make([]*rlwe.Ciphertext, 0, (len(msg)+slots-1)/slots)
+	for i := 0; i < len(msg); i += slots {
+		end := i + slots
+		if end > len(msg) {
+			end = len(msg)
+		}
+		ct, err := ctx.EncryptFloats(msg[i:end])
+		if err != nil {
+			return nil, err
+		}
+		cts = append(cts, ct)
+	}
+	return cts, nil
+}
+
+// encryptBatch encrypts msgs in one ciphertext, where msgs[i] is placed at i * block.
+func (ctx *EncryptionContext) encryptBatch(msgs [][]float64, block int) (*rlwe.Ciphertext, error) {
+	if len(msgs) == 0 || len(msgs)*block > ctx.Parameters.Slots() {
+		return nil, fmt.Errorf("%w: cannot encrypt %d inputs of %d slots in %d slots", ErrShapeMismatch, len(msgs), block, ctx.Parameters.Slots())
+	}
+
+	batched := make([]float64, len(msgs)*block)
+	for i, msg := range msgs {
+		if len(msg) > block {
+			return nil, fmt.Errorf("%w: input %d of length %d does not fit in %d slots", ErrShapeMismatch, i, len(msg), block)
+		}
+		copy(batched[i*block:], msg)
+	}
+	return ctx.EncryptFloats(batched)
+}
+
+// EncryptIm2Col encrypts an image(2D slice) as column form,
+// which enables convolution with kernels.
+// It uses square kernel of kernelSize and equal strides without padding.
+// Use EncryptIm2ColSpec for other convolutions.
+//
+// Refer to TenSeal paper for more information.
+func (ctx *EncryptionContext) EncryptIm2Col(img [][]float64, kernelSize int, stride int) (*rlwe.Ciphertext, error) {
+	encodedImg, err := Im2Col(img, kernelSize, stride)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.EncryptFloats(encodedImg)
+}
+
+// EncryptIm2ColBatch encrypts images(2D slices) as column form in one ciphertext,
+// for HENeuralNet with Batch of batch.
+// Image i is placed at i * Slots / batch, and there can be at most batch images.
+// It uses square kernel of kernelSize and equal strides without padding.
+func (ctx *EncryptionContext) EncryptIm2ColBatch(imgs [][][]float64, kernelSize int, stride int, batch int) (*rlwe.Ciphertext, error) {
+	if batch <= 0 || ctx.Parameters.Slots()%batch != 0 {
+		return nil, fmt.Errorf("%w: invalid batch %d", ErrShapeMismatch, batch)
+	}
+
+	encodedImgs := make([][]float64, len(imgs))
+	for i, img := range imgs {
+		encodedImg, err := Im2Col(img, kernelSize, stride)
+		if err != nil {
+			return nil, fmt.Errorf("image %d: %w", i, err)
+		}
+		encodedImgs[i] = encodedImg
+	}
+	return ctx.encryptBatch(encodedImgs, ctx.Parameters.Slots()/batch)
+}
+
+// EncryptIm2ColChannels encrypts an image with multiple channels(3D slice) as column form.
+// img has shape (channels, X, Y), such as RGB image.
+// It uses square kernel of kernelSize and equal strides without padding.
+func (ctx *EncryptionContext) EncryptIm2ColChannels(img [][][]float64, kernelSize int, stride int) (*rlwe.Ciphertext, error) {
+	encodedImg, err := Im2ColChannels(img, kernelSize, stride)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.EncryptFloats(encodedImg)
+}
+
+// EncryptIm2ColSpec encrypts an image with multiple channels(3D slice) as column form,
+// following spec. spec should be the ConvSpec of the first ConvLayer of the model.
+func (ctx *EncryptionContext) EncryptIm2ColSpec(img [][][]float64, spec ConvSpec) (*rlwe.Ciphertext, error) {
+	encodedImg, err := spec.Im2Col(img)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.EncryptFloats(encodedImg)
+}
+
+// Im2ColChannels encodes an image with multiple channels(3D slice) as column form, and flattens it.
+// This is the message encrypted by EncryptIm2ColChannels.
+func Im2ColChannels(img [][][]float64, kernelSize int, stride int) ([]float64, error) {
+	if len(img) == 0 || len(img[0]) == 0 {
+		return nil, fmt.Errorf("%w: empty image", ErrShapeMismatch)
+	}
+	return NewConvSpec(len(img[0]), len(img[0][0]), kernelSize, stride).Im2Col(img)
+}
+
+// Im2Col encodes an image(2D slice) as column form, and flattens it.
+// This is the message encrypted by EncryptIm2Col.
+func Im2Col(img [][]float64, kernelSize int, stride int) ([]float64, error) {
+	return Im2ColChannels([][][]float64{img}, kernelSize, stride)
+}
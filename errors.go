@@ -0,0 +1,37 @@
+package henn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned by henn.
+// Returned errors wrap one of these with more details,
+// so use errors.Is to check them.
+var (
+	// ErrNotInitialized is returned when HENeuralNet is used before Initialize.
+	ErrNotInitialized = errors.New("model not initialized")
+	// ErrShapeMismatch is returned when the shape of inputs or layers is invalid.
+	ErrShapeMismatch = errors.New("shape mismatch")
+	// ErrInsufficientLevels is returned when the ciphertext runs out of levels.
+	ErrInsufficientLevels = errors.New("insufficient levels")
+	// ErrParametersMismatch is returned when given parameters differ from the expected ones.
+	ErrParametersMismatch = errors.New("parameters mismatch")
+	// ErrInvalidKeys is returned when PublicKeyBundle is malformed or lacks required keys.
+	ErrInvalidKeys = errors.New("invalid keys")
+	// ErrUnsupportedParameters is returned when parameters cannot be selected for the given requirements.
+	ErrUnsupportedParameters = errors.New("unsupported parameters")
+	// ErrUnsupportedLayer is returned when the layer cannot be handled.
+	ErrUnsupportedLayer = errors.New("unsupported layer")
+	// ErrInvalidEncoding is returned when serialized data is malformed.
+	ErrInvalidEncoding = errors.New("invalid encoding")
+)
+
+// recoverError recovers from panic and stores it in err, wrapped with target.
+// Lattigo panics on malformed inputs, so this should be deferred
+// in functions that handle untrusted data.
+func recoverError(err *error, target error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%w: %v", target, r)
+	}
+}
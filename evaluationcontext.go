@@ -0,0 +1,133 @@
+package henn
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// EvaluationContext holds the state of one client needed to evaluate HENeuralNet,
+// which is PublicKeyBundle and Evaluator created from it.
+// It does not hold any layers, so many EvaluationContexts can share one HENeuralNet.
+// It is safe for concurrent use.
+type EvaluationContext struct {
+	Parameters ckks.Parameters
+	Keys       *PublicKeyBundle
+	Evaluator  ckks.Evaluator
+
+	// pool stores evaluators leased by concurrent inferences.
+	pool *sync.Pool
+}
+
+// evaluators is an Evaluator and Encoder pair leased by one inference.
+type evaluators struct {
+	Evaluator ckks.Evaluator
+	Encoder   ckks.Encoder
+}
+
+// NewEvaluationContext creates a new EvaluationContext for this HENeuralNet using sender's PublicKeyBundle.
+// It returns error if keys are malformed, or lack rotation keys needed for this NN.
+// HENeuralNet is not modified, so this can be called concurrently with inference.
+func (nn *HENeuralNet) NewEvaluationContext(keys *PublicKeyBundle) (*EvaluationContext, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("%w: nil keys", ErrInvalidKeys)
+	}
+	if !keys.Parameters.Equals(nn.Parameters) {
+		return nil, ErrParametersMismatch
+	}
+	if err := keys.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, rot := range nn.Rotations() {
+		if rot%nn.Parameters.Slots() == 0 {
+			continue
+		}
+		galEl := nn.Parameters.GaloisElementForColumnRotationBy(rot)
+		if keys.RotationKeys == nil || keys.RotationKeys.Keys[galEl] == nil {
+			return nil, fmt.Errorf("%w: missing rotation key for %d", ErrInvalidKeys, rot)
+		}
+	}
+
+	evaluator, encoder := ckks.NewEvaluator(nn.Parameters, keys.EvaluationKey()), nn.Encoder
+	return &EvaluationContext{
+		Parameters: nn.Parameters,
+		Keys:       keys,
+		Evaluator:  evaluator,
+		pool: &sync.Pool{
+			New: func() interface{} {
+				return &evaluators{Evaluator: evaluator.ShallowCopy(), Encoder: encoder.ShallowCopy()}
+			},
+		},
+	}, nil
+}
+
+// Size returns the size of the evaluation keys held by this context in bytes,
+// which is the relinearization key and rotation keys.
+// This dominates the memory used by the context.
+func (ec *EvaluationContext) Size() int {
+	size := 0
+	if ec.Keys.RelinearizationKey != nil {
+		size += ec.Keys.RelinearizationKey.MarshalBinarySize()
+	}
+	if ec.Keys.RotationKeys != nil {
+		size += ec.Keys.RotationKeys.MarshalBinarySize()
+	}
+	return size
+}
+
+// InferWith executes the forward propagation with the keys of ec.
+// ec should be created by NewEvaluationContext of this HENeuralNet.
+func (nn *HENeuralNet) InferWith(ec *EvaluationContext, ctIn *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	ctOut, err := nn.InferVectorWith(ec, []*rlwe.Ciphertext{ctIn})
+	if err != nil {
+		return nil, err
+	}
+	if len(ctOut) != 1 {
+		return nil, fmt.Errorf("%w: output has %d ciphertexts, use InferVectorWith", ErrShapeMismatch, len(ctOut))
+	}
+	return ctOut[0], nil
+}
+
+// InferVectorWith executes InferVector with the keys of ec.
+// ec should be created by NewEvaluationContext of this HENeuralNet.
+func (nn *HENeuralNet) InferVectorWith(ec *EvaluationContext, ctIn []*rlwe.Ciphertext) ([]*rlwe.Ciphertext, error) {
+	if ec == nil {
+		return nil, ErrNotInitialized
+	}
+	if !ec.Parameters.Equals(nn.Parameters) {
+		return nil, ErrParametersMismatch
+	}
+	return nn.inferVector(ec, ctIn)
+}
+
+// evaluationContext returns the EvaluationContext set by Initialize,
+// or nil if Evaluator was set without Initialize.
+func (nn *HENeuralNet) evaluationContext() *EvaluationContext {
+	if nn.eval == nil || nn.eval.Evaluator != nn.Evaluator {
+		return nil
+	}
+	return nn.eval
+}
+
+// lease returns a copy of this HENeuralNet with its own Evaluator and Encoder from ec,
+// so that it can be used concurrently with other inferences.
+// If ec is nil, Evaluator of this HENeuralNet is copied instead.
+// release should be called after use.
+func (nn *HENeuralNet) lease(ec *EvaluationContext) (leased *HENeuralNet, release func()) {
+	leased = new(HENeuralNet)
+	*leased = *nn
+
+	// Evaluator is set without Initialize, so it is not pooled.
+	if ec == nil {
+		leased.Evaluator = nn.Evaluator.ShallowCopy()
+		leased.Encoder = nn.Encoder.ShallowCopy()
+		return leased, func() {}
+	}
+
+	e := ec.pool.Get().(*evaluators)
+	leased.Keys, leased.Evaluator, leased.Encoder = ec.Keys, e.Evaluator, e.Encoder
+	return leased, func() { ec.pool.Put(e) }
+}
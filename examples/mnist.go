@@ -18,23 +18,29 @@ func main() {
 	// Our model requires depth 6, so we have to choose large enough parameter.
 	params, _ := ckks.NewParametersFromLiteral(hemnist.DefaultParams)
 
-	// Client creates CKKSContext.
-	ctx := henn.NewCKKSContext(params)
+	// Client creates ClientContext, which holds the secret key.
+	ctx := henn.NewClientContext(params)
 
 	// Server initializes the model using pre-trained layers.
-	model := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	model, err := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	if err != nil {
+		panic(err)
+	}
 
 	// Using model information, we calculate the rotation indexes needed
 	// and create rotation keys.
 	rots := model.Rotations()
 	ctx.GenRotationKeys(rots)
 
-	// Client sends evaluation keys to server.
+	// Client sends PublicKeyBundle to server, which contains no secret key.
 	// Server uses this to initialize the model.
-	evk := ctx.EvaluationKey
-	model.Initialize(evk)
+	keys := ctx.PublicKeyBundle()
+	if err := model.Initialize(keys); err != nil {
+		panic(err)
+	}
 
-	// Client encrypts the image using Im2Col, and sends it to server.
+	// Client encrypts the image following model.Input, and sends it to server.
+	// Model.Input can be serialized, so client does not need to know the model.
 	f, err := os.Open("9.jpg")
 	if err != nil {
 		panic(err)
@@ -42,13 +48,22 @@ func main() {
 	img, _, _ := image.Decode(f)
 
 	testCase := hemnist.NormalizeImage(img)
-	encImg := ctx.EncryptIm2Col(testCase, 7, 3) // Our model uses 7*7 Kernel with Stride 3.
+	encImg, err := ctx.EncryptInput(model.Input, testCase)
+	if err != nil {
+		panic(err)
+	}
 
 	// Server calculates the inferred result, and sends it to client.
-	encOutput := model.Infer(encImg)
+	encOutput, err := model.Infer(encImg)
+	if err != nil {
+		panic(err)
+	}
 
 	// Client decrypts the result from the server, and obtains the result.
-	output := ctx.DecryptFloats(encOutput, 10) // 0 ~ 9
+	output, err := ctx.DecryptFloats(encOutput, 10) // 0 ~ 9
+	if err != nil {
+		panic(err)
+	}
 	pred := hemnist.ArgMax(output)
 
 	fmt.Println("Prediction:", pred)
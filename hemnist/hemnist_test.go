@@ -12,17 +12,17 @@ import (
 func BenchmarkInference(b *testing.B) {
 	params, _ := ckks.NewParametersFromLiteral(hemnist.DefaultParams)
 
-	var ctx *henn.CKKSContext
+	var ctx *henn.ClientContext
 	b.Run("CreateContext", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			ctx = henn.NewCKKSContext(params)
+			ctx = henn.NewClientContext(params)
 		}
 	})
 
 	var model *henn.HENeuralNet
 	b.Run("GenNeuralNet", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			model = henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+			model, _ = henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
 		}
 	})
 
@@ -35,15 +35,19 @@ func BenchmarkInference(b *testing.B) {
 
 	b.Run("InitNeuralNet", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			model.Initialize(ctx.EvaluationKey)
+			model.Initialize(ctx.PublicKeyBundle())
 		}
 	})
 
-	testCase := hemnist.ReadAllTestCase("mnist_test.csv")[0]
+	testSets, err := hemnist.ReadAllTestCase("mnist_test.csv")
+	if err != nil {
+		b.Skip(err)
+	}
+	testCase := testSets[0]
 	var encImg *rlwe.Ciphertext
-	b.Run("EncryptIm2Col", func(b *testing.B) {
+	b.Run("EncryptInput", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			encImg = ctx.EncryptIm2Col(testCase.Image, 7, 3)
+			encImg, _ = ctx.EncryptInput(model.Input, testCase.Image)
 		}
 	})
 
@@ -55,24 +59,42 @@ func BenchmarkInference(b *testing.B) {
 }
 
 func TestInference(t *testing.T) {
+	testSets, err := hemnist.ReadAllTestCase("mnist_test.csv")
+	if err != nil {
+		t.Skip(err)
+	}
+
 	params, _ := ckks.NewParametersFromLiteral(hemnist.DefaultParams)
-	ctx := henn.NewCKKSContext(params)
-	model := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	ctx := henn.NewClientContext(params)
+	model, err := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ctx.GenRotationKeys(model.Rotations())
 
-	model.Initialize(ctx.EvaluationKey)
+	if err := model.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
 
-	testSets := hemnist.ReadAllTestCase("mnist_test.csv")
 	N := 64
 	successes := 0
 	for i := 0; i < N; i++ {
 		testCase := testSets[i]
-		encImg := ctx.EncryptIm2Col(testCase.Image, 7, 3)
+		encImg, err := ctx.EncryptInput(model.Input, testCase.Image)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		encOutput := model.Infer(encImg)
+		encOutput, err := model.Infer(encImg)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		output := ctx.DecryptFloats(encOutput, 10)
+		output, err := ctx.DecryptFloats(encOutput, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
 		pred := hemnist.ArgMax(output)
 
 		t.Logf("Prediction: %v, Label: %v, Success: %v\n", pred, testCase.Label, pred == testCase.Label)
@@ -82,3 +104,37 @@ func TestInference(t *testing.T) {
 	}
 	t.Logf("Accuraccy: %v\n", float64(successes)/float64(N)*100)
 }
+
+func TestPlan(t *testing.T) {
+	params, _ := ckks.NewParametersFromLiteral(hemnist.DefaultParams)
+	model, err := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := model.Plan(); err != nil {
+		t.Fatal(err)
+	}
+	if model.RequiredDepth() > params.MaxLevel() {
+		t.Errorf("RequiredDepth %v exceeds MaxLevel %v", model.RequiredDepth(), params.MaxLevel())
+	}
+}
+
+func TestSelectParameters(t *testing.T) {
+	paramsLiteral, err := henn.SelectParameters(hemnist.DefaultLayers, []int{28, 28}, 12, henn.Security128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, err := ckks.NewParametersFromLiteral(paramsLiteral)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model, err := henn.NewHENeuralNet(params, hemnist.DefaultLayers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Plan(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,6 +2,7 @@ package hemnist
 
 import (
 	"encoding/csv"
+	"fmt"
 	"os"
 	"strconv"
 )
@@ -21,25 +22,32 @@ const testSetSize = 10000
 
 // ReadAllTestCase returns normalized MNIST test data with labels.
 // Test data file should be in CSV format. See mnist_test.csv.
-func ReadAllTestCase(filepath string) []TestSet {
+func ReadAllTestCase(filepath string) ([]TestSet, error) {
 	if len(testSets) > 0 {
-		return testSets
+		return testSets, nil
 	}
 
 	f, err := os.Open(filepath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer f.Close()
 
 	rd := csv.NewReader(f)
-	rows, _ := rd.ReadAll()
+	rows, err := rd.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make([]TestSet, 0, testSetSize)
+	for n, row := range rows {
+		if len(row) != imageSize*imageSize+1 {
+			return nil, fmt.Errorf("line %d: expected %d columns, got %d", n+1, imageSize*imageSize+1, len(row))
+		}
 
-	testSets = make([]TestSet, 0, testSetSize)
-	for _, row := range rows {
 		label, err := strconv.Atoi(row[0])
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
 		}
 		row = row[1:]
 
@@ -49,14 +57,15 @@ func ReadAllTestCase(filepath string) []TestSet {
 			for j := 0; j < imageSize; j++ {
 				image[i][j], err = strconv.ParseFloat(row[i*imageSize+j], 64)
 				if err != nil {
-					panic(err)
+					return nil, fmt.Errorf("line %d: %w", n+1, err)
 				}
 				image[i][j] /= 255
 			}
 		}
 
-		testSets = append(testSets, TestSet{Image: image, Label: label})
+		sets = append(sets, TestSet{Image: image, Label: label})
 	}
 
-	return testSets
+	testSets = sets
+	return testSets, nil
 }
@@ -5,7 +5,6 @@ import (
 	"henn"
 
 	"github.com/tuneinsight/lattigo/v4/ckks"
-	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 // DefaultLayers are layers that are pre-trained
@@ -26,29 +25,18 @@ var DefaultParams = ckks.ParametersLiteral{
 }
 
 func init() {
-	activationFn := func(model *henn.HENeuralNet, ct *rlwe.Ciphertext) {
-		model.Evaluator.MulRelin(ct, ct, ct)
-		model.Evaluator.Rescale(ct, model.Parameters.DefaultScale(), ct)
-	}
-
 	DefaultLayers = []henn.Layer{
 		henn.ConvLayer{
-			InputX: 28,
-			InputY: 28,
-			Kernel: [][][]float64{convWeight0, convWeight1, convWeight2, convWeight3},
-			Bias:   convBias,
-			Stride: 3,
-		},
-		henn.ActivationLayer{
-			ActivationFn: activationFn,
+			ConvSpec: henn.NewConvSpec(28, 28, 7, 3),
+			Kernel:   [][][][]float64{{convWeight0}, {convWeight1}, {convWeight2}, {convWeight3}},
+			Bias:     convBias,
 		},
+		henn.Square(),
 		henn.LinearLayer{
 			Weights: lin0Weight,
 			Bias:    lin0Bias,
 		},
-		henn.ActivationLayer{
-			ActivationFn: activationFn,
-		},
+		henn.Square(),
 		henn.LinearLayer{
 			Weights: lin1Weight,
 			Bias:    lin1Bias,
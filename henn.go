@@ -1,40 +1,119 @@
 package henn
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
 // HENeuralNet represents the Neural Network with Homomorphic Encryption Operations.
+//
+// HENeuralNet holds the encoded layers, which are read-only after AddLayers.
+// Keys of clients are held by EvaluationContext, so that one model can serve many clients:
+// create EvaluationContext for each client with NewEvaluationContext,
+// and infer with InferWith or InferVectorWith.
+// Initialize binds a single EvaluationContext to this HENeuralNet, used by Infer and InferVector.
+//
+// Infer, InferVector and Profile are safe to call concurrently:
+// each call leases its own shallow copy of Evaluator and Encoder from a pool,
+// so that their internal buffers are not shared.
+// Other methods, such as Initialize and AddLayers, and modifying the fields
+// should not be done concurrently with inference.
 type HENeuralNet struct {
-	Parameters    ckks.Parameters
-	EvaluationKey rlwe.EvaluationKey
-	Encoder       ckks.Encoder
-	Evaluator     ckks.Evaluator
-	Layers        []EncodedLayer
+	Parameters ckks.Parameters
+	Keys       *PublicKeyBundle
+	Encoder    ckks.Encoder
+	Evaluator  ckks.Evaluator
+	Layers     []EncodedLayer
+
+	// Workers is the number of goroutines used to evaluate convolution kernels.
+	// If Workers <= 1, kernels are evaluated sequentially.
+	// Usually, runtime.NumCPU() is a good choice.
+	Workers int
+
+	// Batch is the number of inputs packed in one ciphertext.
+	// Input i occupies the block of Parameters.Slots() / Batch slots starting at i * Parameters.Slots() / Batch,
+	// and every layer is evaluated on each block independently.
+	Batch int
+
+	// Input describes how the input should be encrypted.
+	// It is determined by the first layer.
+	Input InputSpec
+
+	// PowerOfTwoRotations restricts rotation keys to rotations by ±2^k.
+	// Other rotations are composed of them at inference time,
+	// which needs much fewer keys at the cost of more key switches.
+	// See RotationTradeoff for the costs of both.
+	// It changes Rotations, so it should be set before generating keys.
+	PowerOfTwoRotations bool
+
+	// eval is the EvaluationContext set by Initialize.
+	eval *EvaluationContext
+
+	// outputSize is the number of values output by Layers,
+	// -1 if Layers keep the input of the network, or 0 if it is unknown, such as after UnmarshalBinary.
+	outputSize int
 }
 
 // NewHENeuralNet returns the empty HENeuralNet with Encoder initialized.
-// To use this NN, you should call initialize with PubicKeySet.
-func NewHENeuralNet(params ckks.Parameters, layers ...Layer) *HENeuralNet {
+// To use this NN, you should call initialize with PublicKeyBundle.
+func NewHENeuralNet(params ckks.Parameters, layers ...Layer) (*HENeuralNet, error) {
+	return NewBatchedHENeuralNet(params, 1, layers...)
+}
+
+// NewBatchedHENeuralNet returns the empty HENeuralNet which infers batch inputs at once.
+// batch should be a power of two, and every layer should fit in Parameters.Slots() / batch slots.
+// Inputs should be encrypted with EncryptInputBatch or EncryptIm2ColBatch,
+// and outputs can be decrypted with DecryptFloatsBatch.
+//
+// Since every layer is evaluated on all blocks at once,
+// one Infer costs the same as the unbatched one.
+// To batch more inputs, use parameters with larger LogSlots.
+func NewBatchedHENeuralNet(params ckks.Parameters, batch int, layers ...Layer) (*HENeuralNet, error) {
+	if batch <= 0 || batch&(batch-1) != 0 || batch > params.Slots() {
+		return nil, fmt.Errorf("%w: batch %d should be a power of two at most %d", ErrShapeMismatch, batch, params.Slots())
+	}
+
 	nn := &HENeuralNet{
 		Parameters: params,
 		Encoder:    ckks.NewEncoder(params),
 		Evaluator:  nil,
+		Batch:      batch,
+		Input:      InputSpec{Batch: batch},
+	}
+	if err := nn.AddLayers(layers...); err != nil {
+		return nil, err
 	}
-	nn.AddLayers(layers...)
 
-	return nn
+	return nn, nil
 }
 
-// Initialize intializes this neural network using sender's public evaluation keys.
-func (nn *HENeuralNet) Initialize(evk rlwe.EvaluationKey) {
-	nn.EvaluationKey = evk
-	nn.Evaluator = ckks.NewEvaluator(nn.Parameters, evk)
+// Initialize intializes this neural network using sender's PublicKeyBundle.
+// It returns error if keys are malformed, or lack rotation keys needed for this NN.
+// To serve more than one client, use NewEvaluationContext instead.
+func (nn *HENeuralNet) Initialize(keys *PublicKeyBundle) error {
+	ec, err := nn.NewEvaluationContext(keys)
+	if err != nil {
+		return err
+	}
+
+	nn.Keys = ec.Keys
+	nn.Evaluator = ec.Evaluator
+	nn.eval = ec
+	return nil
 }
 
 // Rotations returns the number of rotations that are needed to infer from this neural network.
+// If PowerOfTwoRotations is set, only rotations by ±2^k are returned.
 func (nn *HENeuralNet) Rotations() []int {
+	return nn.rotations(nn.PowerOfTwoRotations)
+}
+
+// fullRotations returns every rotation done by the layers of this neural network,
+// when PowerOfTwoRotations is not set.
+func (nn *HENeuralNet) fullRotations() []int {
 	rotSet := make(map[int]struct{})
 
 	for _, l := range nn.Layers {
@@ -63,6 +142,24 @@ func (nn *HENeuralNet) Rotations() []int {
 			for _, r := range l.Weights.Rotations() {
 				rotSet[r] = struct{}{}
 			}
+			for c := 1; c < l.Copies; c <<= 1 {
+				rotSet[-c*l.InputSize] = struct{}{}
+			}
+			for s := l.InputSize / 2; l.OutputSize > 0 && s >= l.OutputSize; s >>= 1 {
+				rotSet[s] = struct{}{}
+			}
+		case EncodedTiledLinearLayer:
+			for _, row := range l.Weights {
+				for _, lt := range row {
+					for _, r := range lt.Rotations() {
+						rotSet[r] = struct{}{}
+					}
+				}
+			}
+		case EncodedAvgPoolLayer:
+			for _, r := range l.Weights.Rotations() {
+				rotSet[r] = struct{}{}
+			}
 		}
 	}
 
@@ -74,83 +171,293 @@ func (nn *HENeuralNet) Rotations() []int {
 }
 
 // AddLayers adds layers to this HENeuralNet.
-func (nn *HENeuralNet) AddLayers(layers ...Layer) {
+// If any layer is invalid, no layers are added.
+// If this HENeuralNet is empty, Input is set from the first layer.
+func (nn *HENeuralNet) AddLayers(layers ...Layer) error {
+	input := nn.Input
+
+	// Levels left after all layers, which can be spent on folded linear layers.
+	spare := nn.Parameters.MaxLevel() - nn.RequiredDepth()
 	for _, l := range layers {
+		spare -= layerDepth(l)
+	}
+
+	outputSize := nn.outputSize
+	if len(nn.Layers) == 0 {
+		outputSize = -1
+	}
+	encodedLayers := make([]EncodedLayer, 0, len(layers))
+	for i, l := range layers {
+		var el EncodedLayer
+		var err error
+
 		switch l := l.(type) {
 		case ConvLayer:
-			nn.Layers = append(nn.Layers, nn.EncodeConvLayer(l))
+			el, err = nn.EncodeConvLayer(l)
 		case LinearLayer:
-			nn.Layers = append(nn.Layers, nn.EncodeLinearLayer(l))
+			if l.check(nn.blockSize()) == nil {
+				// Replicated encodings read the previous output after M values,
+				// so they are used only if it is known to fit in M values.
+				// The input of the network is encrypted for this layer.
+				prev := append(append([]EncodedLayer(nil), nn.Layers...), encodedLayers...)
+				fits := outputSize == -1 || (outputSize > 0 && outputSize <= len(l.Weights[0]))
+				el, err = nn.encodeLinearLayer(l, fits && zeroPadded(prev), spare > 0)
+			} else {
+				el, err = nn.EncodeTiledLinearLayer(l)
+			}
+		case AvgPoolLayer:
+			el, err = nn.EncodeAvgPoolLayer(l)
+		case FeatureConvLayer:
+			el, err = nn.EncodeFeatureConvLayer(l)
 		case ActivationLayer:
-			nn.Layers = append(nn.Layers, l)
+			if l.ActivationFn == nil {
+				err = fmt.Errorf("%w: nil ActivationFn", ErrUnsupportedLayer)
+			}
+			el = l
+		case PolyActivation:
+			err = l.check()
+			el = l
+		default:
+			err = fmt.Errorf("%w: %T", ErrUnsupportedLayer, l)
 		}
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", i, err)
+		}
+		spare -= layerDepth(el) - layerDepth(l)
+
+		if len(nn.Layers) == 0 && len(encodedLayers) == 0 {
+			if spec, ok := inputSpec(l); ok {
+				spec.Batch = nn.Batch
+				input = spec
+			}
+		}
+		encodedLayers = append(encodedLayers, el)
+		outputSize = layerOutputSize(l, outputSize)
 	}
+
+	nn.Layers = append(nn.Layers, encodedLayers...)
+	nn.Input = input
+	nn.outputSize = outputSize
+	return nil
 }
 
 // Infer executes the forward propagation, returning inferred value.
 // If this network starts with ConvLayer, input should be encoded with EncryptIm2Col.
 // Analogous to forward() in TenSeal.
-func (nn *HENeuralNet) Infer(ctIn *rlwe.Ciphertext) *rlwe.Ciphertext {
+//
+// Infer takes and returns one ciphertext.
+// Use InferVector if the input or output of this network does not fit in one ciphertext.
+func (nn *HENeuralNet) Infer(ctIn *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	ctOut, err := nn.InferVector([]*rlwe.Ciphertext{ctIn})
+	if err != nil {
+		return nil, err
+	}
+	if len(ctOut) != 1 {
+		return nil, fmt.Errorf("%w: output has %d ciphertexts, use InferVector", ErrShapeMismatch, len(ctOut))
+	}
+	return ctOut[0], nil
+}
+
+// InferVector executes the forward propagation on the input of multiple ciphertexts,
+// returning the output ciphertexts.
+// Values of a layer are split into multiple ciphertexts if they do not fit in one,
+// where ciphertext i holds the values from i * Slots, as EncryptFloatsVector does.
+// Only EncodedTiledLinearLayer changes the number of ciphertexts,
+// and activations are applied to every ciphertext.
+// Other layers take exactly one ciphertext.
+func (nn *HENeuralNet) InferVector(ctIn []*rlwe.Ciphertext) ([]*rlwe.Ciphertext, error) {
 	if nn.Evaluator == nil {
-		panic("model not initialized")
+		return nil, ErrNotInitialized
 	}
+	return nn.inferVector(nn.evaluationContext(), ctIn)
+}
 
-	ctOut := ctIn.CopyNew()
+// inferVector executes InferVector with the evaluators leased from ec.
+func (nn *HENeuralNet) inferVector(ec *EvaluationContext, ctIn []*rlwe.Ciphertext) ([]*rlwe.Ciphertext, error) {
+	if len(ctIn) == 0 {
+		return nil, fmt.Errorf("%w: empty input", ErrShapeMismatch)
+	}
+	for _, ct := range ctIn {
+		if ct == nil || ct.Degree() != 1 || ct.Value[0].N() != nn.Parameters.N() || ct.Level() > nn.Parameters.MaxLevel() {
+			return nil, fmt.Errorf("%w: malformed ciphertext", ErrShapeMismatch)
+		}
+	}
 
-	for _, l := range nn.Layers {
+	if _, err := nn.plan(ctIn[0].Level(), ctIn[0].Scale); err != nil {
+		return nil, err
+	}
+
+	leased, release := nn.lease(ec)
+	defer release()
+	return leased.infer(ctIn, nil)
+}
+
+// infer executes InferVector, calling hook with the output of each layer if hook is not nil.
+func (nn *HENeuralNet) infer(ctIn []*rlwe.Ciphertext, hook func(i int, ct []*rlwe.Ciphertext) error) (ctOut []*rlwe.Ciphertext, err error) {
+	// Lattigo panics on invalid operations.
+	// Convert them to errors, so that one malformed request cannot kill the whole process.
+	defer recoverError(&err, ErrShapeMismatch)
+
+	ctOut = make([]*rlwe.Ciphertext, len(ctIn))
+	for i, ct := range ctIn {
+		ctOut[i] = ct.CopyNew()
+	}
+
+	for i, l := range nn.Layers {
 		switch l := l.(type) {
-		case EncodedConvLayer:
-			nn.conv(l, ctOut)
-		case EncodedLinearLayer:
-			nn.linear(l, ctOut)
+		case EncodedTiledLinearLayer:
+			ctOut, err = nn.tiledLinear(l, ctOut)
+		case ActivationLayer, PolyActivation:
+			// Activations are slot-wise, so they are applied to each ciphertext.
+			for _, ct := range ctOut {
+				if err = nn.evaluate(l, ct); err != nil {
+					break
+				}
+			}
+		default:
+			if len(ctOut) != 1 {
+				err = fmt.Errorf("%w: %s layer takes one ciphertext, got %d", ErrShapeMismatch, layerName(l), len(ctOut))
+				break
+			}
+			err = nn.evaluate(l, ctOut[0])
+		}
+		if err == nil && hook != nil {
+			err = hook(i, ctOut)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	return ctOut, nil
+}
+
+// evaluate executes l on ct in-place.
+func (nn *HENeuralNet) evaluate(l EncodedLayer, ct *rlwe.Ciphertext) error {
+	switch l := l.(type) {
+	case EncodedConvLayer:
+		return nn.conv(l, ct)
+	case EncodedLinearLayer:
+		return nn.linear(l, ct)
+	case EncodedAvgPoolLayer:
+		return nn.avgPool(l, ct)
+	case ActivationLayer:
+		return nn.activate(l, ct)
+	case PolyActivation:
+		return nn.polyActivate(l, ct)
+	}
+	return fmt.Errorf("%w: %T", ErrUnsupportedLayer, l)
+}
+
+// zeroPadded returns true if the output of layers is known to be zero after its values,
+// in every block. The input of the network is zero padded by EncryptionContext.
+// Linear layers, convolutions and pooling always have zero padded outputs,
+// and activations keep zeros if they map zero to zero.
+func zeroPadded(layers []EncodedLayer) bool {
+	for i := len(layers) - 1; i >= 0; i-- {
+		switch l := layers[i].(type) {
+		case EncodedConvLayer, EncodedLinearLayer, EncodedTiledLinearLayer, EncodedAvgPoolLayer:
+			return true
+		case PolyActivation:
+			if l.Coeffs[0] != 0 {
+				return false
+			}
 		case ActivationLayer:
-			nn.activate(l, ctOut)
+			if l.PlaintextFn == nil || l.PlaintextFn(0) != 0 {
+				return false
+			}
+		default:
+			return false
 		}
 	}
+	return true
+}
 
-	return ctOut
+// layerOutputSize returns the number of values output by l,
+// taking the input of size values.
+// Activations keep the size.
+func layerOutputSize(l Layer, size int) int {
+	switch l := l.(type) {
+	case ConvLayer:
+		c, x, y := l.OutputShape()
+		return c * x * y
+	case FeatureConvLayer:
+		c, x, y := l.OutputShape()
+		return c * x * y
+	case AvgPoolLayer:
+		c, x, y := l.OutputShape()
+		return c * x * y
+	case LinearLayer:
+		return len(l.Weights)
+	}
+	return size
+}
+
+// blockSize returns the number of slots for each input.
+func (nn *HENeuralNet) blockSize() int {
+	if nn.Batch <= 1 {
+		return nn.Parameters.Slots()
+	}
+	return nn.Parameters.Slots() / nn.Batch
+}
+
+// encodeBatch encodes v repeated for each block,
+// so that it is applied to every input in the batch.
+func (nn *HENeuralNet) encodeBatch(v []float64) *rlwe.Plaintext {
+	block := nn.blockSize()
+	repeated := make([]float64, nn.Parameters.Slots())
+	for b := 0; b < len(repeated); b += block {
+		copy(repeated[b:], v)
+	}
+	return nn.Encoder.EncodeNew(repeated, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), nn.Parameters.LogSlots())
+}
+
+// Rescale rescales ct in-place to the default scale,
+// returning ErrInsufficientLevels if ct has no more levels.
+// Custom ActivationLayers should use this instead of Evaluator.Rescale.
+func (nn *HENeuralNet) Rescale(ct *rlwe.Ciphertext) error {
+	if ct.Level() == 0 {
+		return ErrInsufficientLevels
+	}
+	return nn.Evaluator.Rescale(ct, nn.Parameters.DefaultScale(), ct)
 }
 
 // EncodeConvLayer encodes ConvLayer to EncodedConvLayer.
-func (nn *HENeuralNet) EncodeConvLayer(cl ConvLayer) EncodedConvLayer {
-	if len(cl.Kernel) != len(cl.Bias) {
-		panic("dimension mismatch between kernel and bias")
+func (nn *HENeuralNet) EncodeConvLayer(cl ConvLayer) (EncodedConvLayer, error) {
+	if err := cl.check(nn.blockSize()); err != nil {
+		return EncodedConvLayer{}, err
 	}
 
-	kx := len(cl.Kernel[0])
-	ky := len(cl.Kernel[0][0])
-	kSize := kx * ky
-	repeat := ((cl.InputX - kx + cl.Stride) / cl.Stride) * ((cl.InputY - ky + cl.Stride) / cl.Stride)
-	// imgSize := windowSize * repeat
+	kSize, repeat := cl.im2ColSize()
 
 	encodedKernels := make([]*rlwe.Plaintext, len(cl.Kernel))
 	for i, k := range cl.Kernel {
 		// Repeat and flatten kernels
-		flattenedKernel := make([]float64, 0, repeat*kSize)
-		for i := 0; i < kx; i++ {
-			for j := 0; j < ky; j++ {
-				for n := 0; n < repeat; n++ {
-					flattenedKernel = append(flattenedKernel, k[i][j])
-				}
+		// Input channels are stacked in Im2Col encoding,
+		// so InnerSum also sums across input channels.
+		repeatedKernel := make([]float64, 0, repeat*kSize)
+		for _, w := range flattenKernel(k) {
+			for n := 0; n < repeat; n++ {
+				repeatedKernel = append(repeatedKernel, w)
 			}
 		}
-		encodedKernels[i] = nn.Encoder.EncodeNew(flattenedKernel, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), nn.Parameters.LogSlots())
+		encodedKernels[i] = nn.encodeBatch(repeatedKernel)
 	}
 
 	encodedBiases := make([]*rlwe.Plaintext, len(cl.Bias))
 	for i, b := range cl.Bias {
-		repeatedBias := make([]float64, kSize)
+		repeatedBias := make([]float64, repeat)
 		for j := range repeatedBias {
 			repeatedBias[j] = b
 		}
-		encodedBiases[i] = nn.Encoder.EncodeNew(repeatedBias, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), nn.Parameters.LogSlots())
+		encodedBiases[i] = nn.encodeBatch(repeatedBias)
 	}
 
-	mask := make([]float64, kSize)
+	mask := make([]float64, repeat)
 	for i := range mask {
 		mask[i] = 1
 	}
-	encodedMask := nn.Encoder.EncodeNew(mask, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), nn.Parameters.LogSlots())
+	encodedMask := nn.encodeBatch(mask)
 
 	return EncodedConvLayer{
 		Im2ColX: kSize,
@@ -159,74 +466,543 @@ func (nn *HENeuralNet) EncodeConvLayer(cl ConvLayer) EncodedConvLayer {
 
 		Kernel: encodedKernels,
 		Bias:   encodedBiases,
-		Stride: cl.Stride,
-	}
+		Stride: cl.StrideX,
+	}, nil
 }
 
 // conv executes ConvLayer in-place.
-func (nn *HENeuralNet) conv(cl EncodedConvLayer, ct *rlwe.Ciphertext) {
+// If Workers > 1, kernels are split across workers,
+// and their outputs are summed with a reduction tree.
+func (nn *HENeuralNet) conv(cl EncodedConvLayer, ct *rlwe.Ciphertext) error {
+	workers := nn.Workers
+	if workers > len(cl.Kernel) {
+		workers = len(cl.Kernel)
+	}
+	if workers <= 1 {
+		ct.Copy(nn.convKernels(nn.Evaluator, cl, ct, 0, 1))
+		return nn.Rescale(ct)
+	}
+
+	// Evaluator has internal buffers, so each worker needs its own.
+	evaluators := make([]ckks.Evaluator, workers)
+	evaluators[0] = nn.Evaluator
+	for w := 1; w < workers; w++ {
+		evaluators[w] = nn.Evaluator.ShallowCopy()
+	}
+
+	ctConv := make([]*rlwe.Ciphertext, workers)
+	if err := parallel(workers, func(w int) {
+		ctConv[w] = nn.convKernels(evaluators[w], cl, ct, w, workers)
+	}); err != nil {
+		return err
+	}
+
+	for step := 1; step < workers; step <<= 1 {
+		step := step
+		if err := parallel((workers+2*step-1)/(2*step), func(i int) {
+			if i, j := 2*step*i, 2*step*i+step; j < workers {
+				evaluators[i].Add(ctConv[i], ctConv[j], ctConv[i])
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	ct.Copy(ctConv[0])
+	return nn.Rescale(ct)
+}
+
+// convKernels executes kernels start, start+step, ... of ConvLayer on ct using eval,
+// returning the sum of their outputs.
+// ct is not modified, so it can be shared across workers.
+func (nn *HENeuralNet) convKernels(eval ckks.Evaluator, cl EncodedConvLayer, ct *rlwe.Ciphertext, start, step int) *rlwe.Ciphertext {
 	ctConv := rlwe.NewCiphertext(nn.Parameters.Parameters, ct.Degree(), ct.Level())
 	ctTemp := rlwe.NewCiphertext(nn.Parameters.Parameters, ct.Degree(), ct.Level())
-	for i := range cl.Kernel {
+	for i := start; i < len(cl.Kernel); i += step {
 		k := cl.Kernel[i]
 		b := cl.Bias[i]
 
 		// y = k * x + b
-		nn.Evaluator.Mul(ct, k, ctTemp)
-		nn.Evaluator.InnerSum(ctTemp, cl.Im2ColY, cl.Im2ColX, ctTemp)
-		nn.Evaluator.Add(ctTemp, b, ctTemp)
+		eval.Mul(ct, k, ctTemp)
+		nn.innerSum(eval, ctTemp, cl.Im2ColY, cl.Im2ColX, ctTemp)
+		eval.Add(ctTemp, b, ctTemp)
 
 		// Mask and Rotate
-		nn.Evaluator.Mul(ctTemp, cl.mask, ctTemp)
-		nn.Evaluator.Rotate(ctTemp, -i*cl.Im2ColY, ctTemp)
-		nn.Evaluator.Add(ctConv, ctTemp, ctConv)
+		eval.Mul(ctTemp, cl.mask, ctTemp)
+		nn.rotate(eval, ctTemp, -i*cl.Im2ColY, ctTemp)
+		eval.Add(ctConv, ctTemp, ctConv)
+	}
+	return ctConv
+}
+
+// parallel calls f(0), ..., f(n-1) in separate goroutines, and waits for them.
+// Lattigo panics on invalid operations, and panics in goroutines cannot be recovered by the caller,
+// so they are converted to errors here.
+func parallel(n int, f func(i int)) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer recoverError(&errs[i], ErrShapeMismatch)
+			f(i)
+		}(i)
 	}
+	wg.Wait()
 
-	ct.Copy(ctConv)
-	nn.Evaluator.Rescale(ct, nn.Parameters.DefaultScale(), ct)
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // EncodeLinearLayer encodes LinearLayer to EncodedLinearLayer.
-func (nn *HENeuralNet) EncodeLinearLayer(ll LinearLayer) EncodedLinearLayer {
-	N := len(ll.Weights)
-	M := len(ll.Weights[0])
+// Only the N+M-1 diagonals that can be nonzero are encoded,
+// where the weights have shape N*M.
+//
+// AddLayers uses the rectangular encoding of min(N, M) diagonals instead,
+// when the input of the layer is known to be zero after M values.
+// If N < M, the output is folded and masked, which consumes one more level,
+// so this is done only if the levels of the parameters allow it.
+func (nn *HENeuralNet) EncodeLinearLayer(ll LinearLayer) (EncodedLinearLayer, error) {
+	return nn.encodeLinearLayer(ll, false, false)
+}
 
-	diagWeights := make(map[int][]float64, len(ll.Weights))
-	slots := nn.Parameters.Slots()
-	for i := 0; i < slots; i++ {
-		isZero := true
-		row := make([]float64, slots)
-		for j := 0; j < slots; j++ {
-			ii, jj := j%slots, (i+j)%slots
-			if ii < N && jj < M {
-				row[j] = ll.Weights[ii][jj]
-				if row[j] != 0 {
-					isZero = false
-				}
-			}
-			if !isZero {
-				diagWeights[i] = row
+// encodeLinearLayer encodes LinearLayer to EncodedLinearLayer.
+// If zeroPadded is true, the input is assumed to be zero after M values,
+// and the rectangular encoding is used if it needs fewer diagonals.
+// If fold is also true, N < M weights are encoded with N diagonals, see foldedSize.
+func (nn *HENeuralNet) encodeLinearLayer(ll LinearLayer, zeroPadded, fold bool) (EncodedLinearLayer, error) {
+	if err := ll.check(nn.blockSize()); err != nil {
+		return EncodedLinearLayer{}, err
+	}
+
+	N, M := len(ll.Weights), len(ll.Weights[0])
+	if zeroPadded && fold {
+		if size := foldedSize(N, M, nn.blockSize()); size > 0 {
+			mask := make([]float64, N)
+			for i := range mask {
+				mask[i] = 1
 			}
+
+			return EncodedLinearLayer{
+				Weights:    nn.encodeFoldedWeights(ll.Weights, size),
+				Bias:       nn.encodeBatch(ll.Bias),
+				InputSize:  size,
+				Copies:     2,
+				OutputSize: N,
+				Mask:       nn.encodeBatch(mask),
+			}, nil
 		}
 	}
 
-	encodedWeights := ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots())
-	encodedBias := nn.Encoder.EncodeNew(ll.Bias, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), nn.Parameters.LogSlots())
+	if zeroPadded {
+		if copies := rectangularCopies(N, M, nn.blockSize()); copies > 1 {
+			return EncodedLinearLayer{
+				Weights:   nn.encodeRectangularWeights(ll.Weights),
+				Bias:      nn.encodeBatch(ll.Bias),
+				InputSize: M,
+				Copies:    copies,
+			}, nil
+		}
+	}
 
 	return EncodedLinearLayer{
+		Weights: nn.encodeLinearWeights(ll.Weights),
+		Bias:    nn.encodeBatch(ll.Bias),
+	}, nil
+}
+
+// rectangularCopies returns the number of copies of the input of size M,
+// needed by the rectangular encoding of N*M weights with M diagonals.
+// Diagonal d < M of the rectangular encoding reads the input from d to N+d-1,
+// so the input should be replicated up to N+M-1 values.
+// Copies are doubled by rotations, so it is a power of two.
+// It returns 0 if the copies do not fit in block,
+// or N is 1, where M diagonals do not save any over N+M-1.
+func rectangularCopies(N, M, block int) int {
+	if M >= N+M-1 {
+		return 0
+	}
+
+	copies := 1
+	for copies*M < N+M-1 {
+		copies <<= 1
+	}
+	if copies*M > block {
+		return 0
+	}
+	return copies
+}
+
+// foldedSize returns the size of the zero padded input of N*M weights,
+// for the folded encoding of N diagonals, where N < M.
+// The size is N times the smallest power of two K with N*K >= M,
+// so that the partial sums of K rows of N values are folded
+// by log2(K) rotations and additions.
+// The input is replicated twice, since diagonal d < N reads it from d to size+d-1.
+// It returns 0 if N >= M, or the copies do not fit in block.
+func foldedSize(N, M, block int) int {
+	if N >= M {
+		return 0
+	}
+
+	size := N
+	for size < M {
+		size <<= 1
+	}
+	if 2*size > block {
+		return 0
+	}
+	return size
+}
+
+// EncodeTiledLinearLayer encodes LinearLayer to EncodedTiledLinearLayer,
+// splitting the input and output into ciphertexts of Slots values.
+// This is used when the input or output of LinearLayer does not fit in one ciphertext.
+// Batched networks cannot take inputs of multiple ciphertexts,
+// so it returns ErrShapeMismatch if Batch > 1.
+func (nn *HENeuralNet) EncodeTiledLinearLayer(ll LinearLayer) (EncodedTiledLinearLayer, error) {
+	if err := ll.checkWeights(); err != nil {
+		return EncodedTiledLinearLayer{}, err
+	}
+	if nn.Batch > 1 {
+		return EncodedTiledLinearLayer{}, fmt.Errorf("%w: linear layer of %d*%d does not fit in a block of %d slots with batch %d", ErrShapeMismatch, len(ll.Weights), len(ll.Weights[0]), nn.blockSize(), nn.Batch)
+	}
+
+	tile := nn.blockSize()
+	inTiles, outTiles := ll.tiles(tile)
+
+	encodedWeights := make([][]ckks.LinearTransform, outTiles)
+	encodedBias := make([]*rlwe.Plaintext, outTiles)
+	for i := range encodedWeights {
+		rowStart, rowEnd := tileRange(i, tile, len(ll.Weights))
+		rows := ll.Weights[rowStart:rowEnd]
+
+		isZero := true
+		encodedWeights[i] = make([]ckks.LinearTransform, inTiles)
+		for j := range encodedWeights[i] {
+			colStart, colEnd := tileRange(j, tile, len(rows[0]))
+			block := make([][]float64, len(rows))
+			for r, row := range rows {
+				block[r] = row[colStart:colEnd]
+			}
+			encodedWeights[i][j] = nn.encodeLinearWeights(block)
+			if len(encodedWeights[i][j].Vec) != 0 {
+				isZero = false
+			}
+		}
+
+		// Output ciphertext needs at least one block,
+		// so that it has the same level and scale as others.
+		if isZero {
+			encodedWeights[i][0] = ckks.GenLinearTransformBSGS(nn.Encoder, map[int][]float64{0: make([]float64, nn.Parameters.Slots())}, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots())
+		}
+
+		encodedBias[i] = nn.encodeBatch(ll.Bias[rowStart:rowEnd])
+	}
+
+	return EncodedTiledLinearLayer{
 		Weights: encodedWeights,
 		Bias:    encodedBias,
+	}, nil
+}
+
+// tileRange returns the range of i-th tile of size tile, out of n values.
+func tileRange(i, tile, n int) (int, int) {
+	end := (i + 1) * tile
+	if end > n {
+		end = n
 	}
+	return i * tile, end
+}
+
+// encodeLinearWeights encodes weights as the block diagonal matrix, with weights on each block.
+// weights should fit in one block.
+// If weights are all zero, it returns LinearTransform without diagonals.
+func (nn *HENeuralNet) encodeLinearWeights(weights [][]float64) ckks.LinearTransform {
+	slots, block := nn.Parameters.Slots(), nn.blockSize()
+
+	diagWeights := make(map[int][]float64)
+	for b := 0; b < slots; b += block {
+		for i, row := range weights {
+			for j, w := range row {
+				if w != 0 {
+					addToDiagonal(diagWeights, slots, b+i, b+j, w)
+				}
+			}
+		}
+	}
+
+	if len(diagWeights) == 0 {
+		return ckks.LinearTransform{LogSlots: nn.Parameters.LogSlots(), Level: nn.Parameters.MaxLevel(), Scale: nn.Parameters.DefaultScale()}
+	}
+	return ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots())
+}
+
+// encodeRectangularWeights encodes N*M weights with M diagonals,
+// where the diagonal d is W[i][(i+d) % M] for i < N.
+// This assumes that the input is replicated with period M,
+// so that the input at i+d is the same as (i+d) % M.
+func (nn *HENeuralNet) encodeRectangularWeights(weights [][]float64) ckks.LinearTransform {
+	slots, block := nn.Parameters.Slots(), nn.blockSize()
+	M := len(weights[0])
+
+	diagWeights := make(map[int][]float64, M)
+	for b := 0; b < slots; b += block {
+		for i, row := range weights {
+			for d := 0; d < M; d++ {
+				if w := row[(i+d)%M]; w != 0 {
+					addToDiagonal(diagWeights, slots, b+i, b+i+d, w)
+				}
+			}
+		}
+	}
+
+	if len(diagWeights) == 0 {
+		diagWeights[0] = make([]float64, slots)
+	}
+	return ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots())
+}
+
+// encodeFoldedWeights encodes N*M weights with N diagonals, where N < M.
+// The output at kN+i is the partial sum of W[i][j] for j from kN+i to kN+i+N-1,
+// so that diagonal d is W[i][(kN+i+d) % size] at kN+i for kN < size,
+// and the sum over k gives the output at i.
+// This assumes that the input is zero after M values,
+// and is replicated with period size.
+func (nn *HENeuralNet) encodeFoldedWeights(weights [][]float64, size int) ckks.LinearTransform {
+	slots, block := nn.Parameters.Slots(), nn.blockSize()
+	N, M := len(weights), len(weights[0])
+
+	diagWeights := make(map[int][]float64, N)
+	for b := 0; b < slots; b += block {
+		for k := 0; k < size; k += N {
+			for i, row := range weights {
+				for d := 0; d < N; d++ {
+					if j := (k + i + d) % size; j < M && row[j] != 0 {
+						addToDiagonal(diagWeights, slots, b+k+i, b+k+i+d, row[j])
+					}
+				}
+			}
+		}
+	}
+
+	if len(diagWeights) == 0 {
+		diagWeights[0] = make([]float64, slots)
+	}
+	return ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots())
 }
 
 // linear executes LinearLayer in-place.
-func (nn *HENeuralNet) linear(ll EncodedLinearLayer, ct *rlwe.Ciphertext) {
-	nn.Evaluator.LinearTransform(ct, ll.Weights, []*rlwe.Ciphertext{ct})
-	nn.Evaluator.Rescale(ct, nn.Parameters.DefaultScale(), ct)
+func (nn *HENeuralNet) linear(ll EncodedLinearLayer, ct *rlwe.Ciphertext) error {
+	if ll.Copies > 1 {
+		// Replicate the input for the rectangular encoding.
+		// Rotations do not consume levels.
+		ctTemp := rlwe.NewCiphertext(nn.Parameters.Parameters, ct.Degree(), ct.Level())
+		for c := 1; c < ll.Copies; c <<= 1 {
+			nn.rotate(nn.Evaluator, ct, -c*ll.InputSize, ctTemp)
+			nn.Evaluator.Add(ct, ctTemp, ct)
+		}
+	}
+
+	nn.linearTransform(nn.Evaluator, ct, ll.Weights, ct)
+	if ll.OutputSize > 0 {
+		// Fold the partial sums to the first OutputSize values,
+		// and clear the others.
+		ctTemp := rlwe.NewCiphertext(nn.Parameters.Parameters, ct.Degree(), ct.Level())
+		for s := ll.InputSize / 2; s >= ll.OutputSize; s >>= 1 {
+			nn.rotate(nn.Evaluator, ct, s, ctTemp)
+			nn.Evaluator.Add(ct, ctTemp, ct)
+		}
+		nn.Evaluator.Mul(ct, ll.Mask, ct)
+	}
+	if err := nn.Rescale(ct); err != nil {
+		return err
+	}
 	nn.Evaluator.Add(ct, ll.Bias, ct)
+	return nil
+}
+
+// tiledLinear executes EncodedTiledLinearLayer, returning the output ciphertexts.
+func (nn *HENeuralNet) tiledLinear(ll EncodedTiledLinearLayer, ctIn []*rlwe.Ciphertext) ([]*rlwe.Ciphertext, error) {
+	if len(ll.Weights) == 0 {
+		return nil, fmt.Errorf("%w: empty tiled linear layer", ErrShapeMismatch)
+	}
+	if len(ctIn) != len(ll.Weights[0]) {
+		return nil, fmt.Errorf("%w: tiled linear layer takes %d ciphertexts, got %d", ErrShapeMismatch, len(ll.Weights[0]), len(ctIn))
+	}
+
+	ctOut := make([]*rlwe.Ciphertext, len(ll.Weights))
+	for i, row := range ll.Weights {
+		var ctTemp *rlwe.Ciphertext
+		for j, lt := range row {
+			if len(lt.Vec) == 0 {
+				continue
+			}
+
+			if ctOut[i] == nil {
+				ctOut[i] = ckks.NewCiphertext(nn.Parameters, 1, ctIn[j].Level())
+				nn.linearTransform(nn.Evaluator, ctIn[j], lt, ctOut[i])
+				continue
+			}
+			if ctTemp == nil {
+				ctTemp = ckks.NewCiphertext(nn.Parameters, 1, ctIn[j].Level())
+			}
+			nn.linearTransform(nn.Evaluator, ctIn[j], lt, ctTemp)
+			nn.Evaluator.Add(ctOut[i], ctTemp, ctOut[i])
+		}
+
+		if err := nn.Rescale(ctOut[i]); err != nil {
+			return nil, err
+		}
+		nn.Evaluator.Add(ctOut[i], ll.Bias[i], ctOut[i])
+	}
+
+	return ctOut, nil
+}
+
+// EncodeAvgPoolLayer encodes AvgPoolLayer to EncodedAvgPoolLayer.
+// Averaging and gathering the windows are done by a single linear transformation.
+func (nn *HENeuralNet) EncodeAvgPoolLayer(pl AvgPoolLayer) (EncodedAvgPoolLayer, error) {
+	if err := pl.check(nn.blockSize()); err != nil {
+		return EncodedAvgPoolLayer{}, err
+	}
+
+	slots, block := nn.Parameters.Slots(), nn.blockSize()
+	_, outX, outY := pl.OutputShape()
+	inSize, outSize := pl.InputX*pl.InputY, outX*outY
+	scale := 1 / float64(pl.Window*pl.Window)
+
+	diagWeights := make(map[int][]float64)
+	for b := 0; b < slots; b += block {
+		for c := 0; c < pl.Channels; c++ {
+			for i := 0; i < outX; i++ {
+				for j := 0; j < outY; j++ {
+					out := c*outSize + i*outY + j
+					for di := 0; di < pl.Window; di++ {
+						for dj := 0; dj < pl.Window; dj++ {
+							in := c*inSize + (i*pl.Stride+di)*pl.InputY + j*pl.Stride + dj
+							addToDiagonal(diagWeights, slots, b+out, b+in, scale)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return EncodedAvgPoolLayer{
+		Weights: ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots()),
+	}, nil
+}
+
+// EncodeFeatureConvLayer encodes FeatureConvLayer to EncodedLinearLayer.
+// Convolution on feature maps is a linear transformation,
+// so it is evaluated with rotations and plaintext diagonal multiplications.
+func (nn *HENeuralNet) EncodeFeatureConvLayer(fl FeatureConvLayer) (EncodedLinearLayer, error) {
+	if err := fl.check(nn.blockSize()); err != nil {
+		return EncodedLinearLayer{}, err
+	}
+
+	slots, block := nn.Parameters.Slots(), nn.blockSize()
+	_, outX, outY := fl.OutputShape()
+	inSize, outSize := fl.InputX*fl.InputY, outX*outY
+
+	diagWeights := make(map[int][]float64)
+	bias := make([]float64, len(fl.Kernel)*outSize)
+	for o, k := range fl.Kernel {
+		for i := 0; i < outX; i++ {
+			for j := 0; j < outY; j++ {
+				out := o*outSize + i*outY + j
+				bias[out] = fl.Bias[o]
+				for c := range k {
+					for di := 0; di < fl.KernelX; di++ {
+						for dj := 0; dj < fl.KernelY; dj++ {
+							// Padding is zero, so it can be skipped
+							in, ok := fl.inputIndex(i*fl.StrideX+di, j*fl.StrideY+dj)
+							if !ok {
+								continue
+							}
+							for b := 0; b < slots; b += block {
+								addToDiagonal(diagWeights, slots, b+out, b+c*inSize+in, k[c][di][dj])
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return EncodedLinearLayer{
+		Weights: ckks.GenLinearTransformBSGS(nn.Encoder, diagWeights, nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale(), 1.0, nn.Parameters.LogSlots()),
+		Bias:    nn.encodeBatch(bias),
+	}, nil
+}
+
+// addToDiagonal adds v to the (i, j) entry of the slots * slots matrix,
+// represented by its diagonals.
+// This is the input format of ckks.GenLinearTransformBSGS.
+func addToDiagonal(diags map[int][]float64, slots, i, j int, v float64) {
+	d := (j - i + slots) % slots
+	if _, ok := diags[d]; !ok {
+		diags[d] = make([]float64, slots)
+	}
+	diags[d][i] += v
+}
+
+// avgPool executes AvgPoolLayer in-place.
+func (nn *HENeuralNet) avgPool(pl EncodedAvgPoolLayer, ct *rlwe.Ciphertext) error {
+	nn.linearTransform(nn.Evaluator, ct, pl.Weights, ct)
+	return nn.Rescale(ct)
 }
 
 // activate executes ActivationLayer in-place.
-func (nn *HENeuralNet) activate(l ActivationLayer, ct *rlwe.Ciphertext) {
-	l.ActivationFn(nn, ct)
+func (nn *HENeuralNet) activate(l ActivationLayer, ct *rlwe.Ciphertext) error {
+	return l.ActivationFn(nn, ct)
+}
+
+// polyActivate executes PolyActivation in-place.
+func (nn *HENeuralNet) polyActivate(pa PolyActivation, ct *rlwe.Ciphertext) error {
+	if pa.isSquare() {
+		nn.Evaluator.MulRelin(ct, ct, ct)
+		return nn.Rescale(ct)
+	}
+
+	if ct.Level() < pa.Depth() {
+		return ErrInsufficientLevels
+	}
+
+	if len(pa.Coeffs) == 2 {
+		// EvaluatePoly does not support linear polynomials.
+		// Multiply by plaintext at the scale of the current modulus,
+		// so that it always consumes one level, even for integer coefficients.
+		slope := make([]float64, nn.Parameters.Slots())
+		for i := range slope {
+			slope[i] = pa.Coeffs[1]
+		}
+		pt := nn.Encoder.EncodeNew(slope, ct.Level(), rlwe.NewScale(nn.Parameters.QiFloat64(ct.Level())), nn.Parameters.LogSlots())
+		nn.Evaluator.Mul(ct, pt, ct)
+		nn.Evaluator.AddConst(ct, pa.Coeffs[0], ct)
+		return nn.Rescale(ct)
+	}
+
+	// EvaluatePoly fails on quadratic polynomials, so pad them to cubic ones.
+	// This does not change the depth.
+	coeffs := make([]complex128, len(pa.Coeffs), len(pa.Coeffs)+1)
+	for i, c := range pa.Coeffs {
+		coeffs[i] = complex(c, 0)
+	}
+	if len(coeffs) == 3 {
+		coeffs = append(coeffs, 0)
+	}
+	ctOut, err := nn.Evaluator.EvaluatePoly(ct, ckks.NewPoly(coeffs), ct.Scale)
+	if err != nil {
+		return err
+	}
+	ct.Resize(ctOut.Degree(), ctOut.Level())
+	ct.Copy(ctOut)
+	return nil
 }
@@ -1,19 +1,24 @@
 package henn
 
 import (
+	"bytes"
+	"errors"
+	"henn/internal/testparams"
 	"math"
 	"math/rand"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
 
-var ctx *CKKSContext
+var ctx *ClientContext
 
 func init() {
 	params, _ := ckks.NewParametersFromLiteral(ckks.PN14QP438)
-	ctx = NewCKKSContext(params)
+	ctx = NewClientContext(params)
 }
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -25,7 +30,14 @@ func TestEncryptDecrypt(t *testing.T) {
 		for i := range pt {
 			pt[i] = r.Intn(64) // Too large integers can have errors embedded!
 		}
-		pt2 := ctx.DecryptInts(ctx.EncryptInts(pt), N)
+		ct, err := ctx.EncryptInts(pt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt2, err := ctx.DecryptInts(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if !reflect.DeepEqual(pt, pt2) {
 			t.Fail()
 		}
@@ -36,7 +48,37 @@ func TestEncryptDecrypt(t *testing.T) {
 		for i := range pt {
 			pt[i] = r.Float64()
 		}
-		pt2 := ctx.DecryptFloats(ctx.EncryptFloats(pt), N)
+		ct, err := ctx.EncryptFloats(pt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt2, err := ctx.DecryptFloats(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < N; i++ {
+			if math.Abs(pt[i]-pt2[i]) > 1e-3 {
+				t.Fail()
+			}
+		}
+	})
+
+	t.Run("PublicKey", func(t *testing.T) {
+		keys := ctx.PublicKeyBundle()
+		enc := NewPublicEncryptor(keys.Parameters, keys.PublicKey)
+
+		pt := make([]float64, N)
+		for i := range pt {
+			pt[i] = r.Float64()
+		}
+		ct, err := enc.EncryptFloats(pt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt2, err := ctx.DecryptFloats(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
 		for i := 0; i < N; i++ {
 			if math.Abs(pt[i]-pt2[i]) > 1e-3 {
 				t.Fail()
@@ -64,8 +106,14 @@ func TestIm2Col(t *testing.T) {
 			{1, 2, 3, 4},
 			{5, 6, 7, 8},
 		}
-		ct := ctx.EncryptIm2Col(img, 2, 2)
-		pt := ctx.DecryptInts(ct, 8)
+		ct, err := ctx.EncryptIm2Col(img, 2, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := ctx.DecryptInts(ct, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		if !reflect.DeepEqual(pt, []int{1, 3, 2, 4, 5, 7, 6, 8}) {
 			t.Fail()
@@ -80,8 +128,14 @@ func TestIm2Col(t *testing.T) {
 			{4, 5, 6},
 			{7, 8, 9},
 		}
-		ct := ctx.EncryptIm2Col(img, 2, 1)
-		pt := ctx.DecryptInts(ct, 16)
+		ct, err := ctx.EncryptIm2Col(img, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := ctx.DecryptInts(ct, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		if !reflect.DeepEqual(pt, []int{1, 2, 4, 5, 2, 3, 5, 6, 4, 5, 7, 8, 5, 6, 8, 9}) {
 			t.Fail()
@@ -101,24 +155,437 @@ func TestConv(t *testing.T) {
 	}
 	stride := 1
 	convLayer := ConvLayer{
-		InputX: len(img),
-		InputY: len(img[0]),
-		Kernel: [][][]float64{kernel, kernel},
-		Bias:   []float64{0, 1},
-		Stride: stride,
+		ConvSpec: NewConvSpec(len(img), len(img[0]), 2, stride),
+		Kernel:   [][][][]float64{{kernel}, {kernel}},
+		Bias:     []float64{0, 1},
 	}
 
-	nn := NewHENeuralNet(ctx.Parameters, convLayer)
+	nn, err := NewHENeuralNet(ctx.Parameters, convLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
 	ctx.GenRotationKeys(nn.Rotations())
-	nn.Initialize(ctx.EvaluationKey)
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
 
-	ct := ctx.EncryptIm2Col(img, len(kernel), stride)
-	ct = nn.Infer(ct)
-	pt := ctx.DecryptInts(ct, 8)
+	ct, err := ctx.EncryptIm2Col(img, len(kernel), stride)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := ctx.DecryptInts(ct, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(pt, []int{12, 16, 24, 28, 13, 17, 25, 29}) {
 		t.Fail()
 	}
+
+	t.Run("Windows", func(t *testing.T) {
+		// 9 windows of kernel size 4, so bias and mask should cover 9 slots, not 4.
+		img := make([][]float64, 4)
+		for i := range img {
+			img[i] = []float64{float64(4*i + 1), float64(4*i + 2), float64(4*i + 3), float64(4*i + 4)}
+		}
+		convLayer := ConvLayer{
+			ConvSpec: NewConvSpec(4, 4, 2, 1),
+			Kernel:   [][][][]float64{{{{1, 0}, {0, 1}}}, {{{0, 2}, {0, 0}}}},
+			Bias:     []float64{1, -1},
+		}
+
+		nn, err := NewHENeuralNet(ctx.Parameters, convLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		ct, err := ctx.EncryptIm2Col(img, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := ctx.DecryptInts(ct, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// img[x][y] + img[x+1][y+1] + 1, then 2 * img[x][y+1] - 1, and masked slots.
+		want := []int{8, 10, 12, 16, 18, 20, 24, 26, 28, 3, 5, 7, 11, 13, 15, 19, 21, 23, 0, 0}
+		if !reflect.DeepEqual(pt, want) {
+			t.Fatalf("want %v, got %v", want, pt)
+		}
+	})
+
+	t.Run("Parallel", func(t *testing.T) {
+		convLayer := ConvLayer{ConvSpec: convLayer.ConvSpec}
+		var want []int
+		for i := 0; i < 5; i++ {
+			convLayer.Kernel = append(convLayer.Kernel, [][][]float64{{{float64(i), 1}, {1, 1}}})
+			convLayer.Bias = append(convLayer.Bias, float64(i))
+			// Top-left pixel of each window is weighted by i.
+			for w, topLeft := range []int{1, 2, 4, 5} {
+				want = append(want, pt[w]-topLeft+i*topLeft+i)
+			}
+		}
+
+		nn, err := NewHENeuralNet(ctx.Parameters, convLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ctx.EncryptIm2Col(img, len(kernel), stride)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, workers := range []int{1, 2, 3, 8} {
+			nn.Workers = workers
+			ctOut, err := nn.Infer(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt, err := ctx.DecryptInts(ctOut, len(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pt, want) {
+				t.Errorf("%d workers: want %v, got %v", workers, want, pt)
+			}
+		}
+	})
+}
+
+func TestConvChannels(t *testing.T) {
+	img := make([][][]float64, 3)
+	for c, m := range []float64{1, 10, 100} {
+		img[c] = [][]float64{
+			{1 * m, 2 * m, 3 * m},
+			{4 * m, 5 * m, 6 * m},
+			{7 * m, 8 * m, 9 * m},
+		}
+	}
+	ones := [][]float64{{1, 1}, {1, 1}}
+	zeros := [][]float64{{0, 0}, {0, 0}}
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(3, 3, 2, 1),
+		Kernel: [][][][]float64{
+			{ones, zeros, ones},
+			{ones, ones, ones},
+		},
+		Bias: []float64{0, 1},
+	}
+
+	nn, err := NewHENeuralNet(ctx.Parameters, convLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := ctx.EncryptIm2ColChannels(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := ctx.DecryptInts(ct, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(pt, []int{1212, 1616, 2424, 2828, 1333, 1777, 2665, 3109}) {
+		t.Errorf("got %v", pt)
+	}
+
+	t.Run("ChannelMismatch", func(t *testing.T) {
+		if _, err := SelectParameters([]Layer{convLayer}, []int{2, 3, 3}, 20, Security128); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+		if _, err := ctx.EncryptIm2ColChannels([][][]float64{img[0], img[1][:2]}, 2, 1); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+}
+
+func TestConvSpec(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+
+	img := make([][]float64, 4)
+	for i := range img {
+		img[i] = make([]float64, 5)
+		for j := range img[i] {
+			img[i][j] = r.Float64()
+		}
+	}
+	kernel := [][]float64{
+		{r.Float64(), r.Float64()},
+		{r.Float64(), r.Float64()},
+		{r.Float64(), r.Float64()},
+	}
+	spec := ConvSpec{
+		InputX:  4,
+		InputY:  5,
+		KernelX: 3,
+		KernelY: 2,
+		StrideX: 2,
+		StrideY: 1,
+		Padding: SamePadding,
+	}
+
+	outX, outY := spec.OutputSize()
+	if outX != 2 || outY != 5 {
+		t.Fatalf("OutputSize: %v %v", outX, outY)
+	}
+
+	// Same padding pads one row to the bottom, and one column to the right.
+	want := make([]float64, 0, outX*outY)
+	for i := 0; i < outX; i++ {
+		for j := 0; j < outY; j++ {
+			v := 0.5
+			for di := range kernel {
+				for dj := range kernel[di] {
+					if x, y := i*2+di, j+dj; x < 4 && y < 5 {
+						v += kernel[di][dj] * img[x][y]
+					}
+				}
+			}
+			want = append(want, v)
+		}
+	}
+
+	for _, l := range []Layer{
+		ConvLayer{ConvSpec: spec, Kernel: [][][][]float64{{kernel}}, Bias: []float64{0.5}},
+		FeatureConvLayer{ConvSpec: spec, Kernel: [][][][]float64{{kernel}}, Bias: []float64{0.5}},
+	} {
+		nn, err := NewHENeuralNet(ctx.Parameters, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		ct, err := ctx.EncryptInput(nn.Input, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloats(ct, len(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range want {
+			if math.Abs(want[i]-got[i]) > 1e-3 {
+				t.Fatalf("%T: slot %d: want %v, got %v", l, i, want[i], got[i])
+			}
+		}
+	}
+
+	t.Run("ShapeMismatch", func(t *testing.T) {
+		if _, err := ctx.EncryptIm2ColSpec([][][]float64{img[:3]}, spec); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+		l := ConvLayer{ConvSpec: spec, Kernel: [][][][]float64{{kernel[:2]}}, Bias: []float64{0.5}}
+		if _, err := NewHENeuralNet(ctx.Parameters, l); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+}
+
+func TestInputSpec(t *testing.T) {
+	img := [][][]float64{
+		{{1, 2, 3}, {4, 5, 6}},
+		{{7, 8, 9}, {10, 11, 12}},
+	}
+	kernel := [][]float64{{1, 0}, {0, 1}}
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(2, 3, 2, 1),
+		Kernel:   [][][][]float64{{kernel, kernel}},
+		Bias:     []float64{0},
+	}
+
+	nn, err := NewHENeuralNet(ctx.Parameters, convLayer, Square())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nn.Input.Packing != PackingIm2Col || !reflect.DeepEqual(nn.Input.Shape, []int{2, 2, 3}) || nn.Input.Slots != 16 {
+		t.Fatalf("Input: %v", nn.Input)
+	}
+
+	data, err := nn.Input.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec InputSpec
+	if err := spec.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, nn.Input) {
+		t.Fatalf("want %v, got %v", nn.Input, spec)
+	}
+
+	ct, err := ctx.EncryptInput(spec, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloats(ct, spec.Slots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := convLayer.Im2Col(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if math.Abs(want[i]-got[i]) > 1e-6 {
+			t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+
+	t.Run("Vector", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, LinearLayer{Weights: [][]float64{{1, 2, 3}}, Bias: []float64{0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn.Input.Packing != PackingVector || !reflect.DeepEqual(nn.Input.Shape, []int{3}) {
+			t.Fatalf("Input: %v", nn.Input)
+		}
+		if _, err := ctx.EncryptInput(nn.Input, []float64{1, 2, 3}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ShapeMismatch", func(t *testing.T) {
+		for _, data := range []interface{}{
+			img[:1],
+			img[0],
+			[][][]float64{img[0][:1], img[1][:1]},
+			[]float64{1, 2, 3},
+			"image",
+		} {
+			if _, err := ctx.EncryptInput(spec, data); !errors.Is(err, ErrShapeMismatch) {
+				t.Fatalf("%v: want ErrShapeMismatch, got %v", data, err)
+			}
+		}
+
+		large := spec
+		large.Slots = ctx.Parameters.Slots() + 1
+		if _, err := ctx.EncryptInput(large, img); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+	t.Run("TrailingData", func(t *testing.T) {
+		var spec InputSpec
+		if err := spec.UnmarshalBinary(append(append([]byte(nil), data...), 0)); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+	})
+}
+
+func TestFeatureConv(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+
+	img := make([][][]float64, 2)
+	for c := range img {
+		img[c] = testImage(r)
+	}
+	kernels := func(out, in, k int) [][][][]float64 {
+		kernel := make([][][][]float64, out)
+		for o := range kernel {
+			kernel[o] = make([][][]float64, in)
+			for c := range kernel[o] {
+				kernel[o][c] = make([][]float64, k)
+				for i := range kernel[o][c] {
+					kernel[o][c][i] = make([]float64, k)
+					for j := range kernel[o][c][i] {
+						kernel[o][c][i][j] = r.Float64() - 0.5
+					}
+				}
+			}
+		}
+		return kernel
+	}
+
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(5, 5, 2, 1),
+		Kernel:   kernels(3, 2, 2),
+		Bias:     []float64{0.1, 0.2, 0.3},
+	}
+	_, x, y := convLayer.OutputShape()
+	featureConvLayer := FeatureConvLayer{
+		ConvSpec: NewConvSpec(x, y, 2, 2),
+		Kernel:   kernels(2, 3, 2),
+		Bias:     []float64{0.4, 0.5},
+	}
+	layers := []Layer{convLayer, Square(), featureConvLayer}
+
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := Im2ColChannels(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := ctx.EncryptFloats(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloats(ct, ctx.Parameters.Slots())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outC, outX, outY := featureConvLayer.OutputShape()
+	if outC*outX*outY != 8 {
+		t.Errorf("OutputShape: %v %v %v", outC, outX, outY)
+	}
+	for i := range want {
+		if math.Abs(want[i]-got[i]) > 1e-3 {
+			t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
 }
 
 func TestLinear(t *testing.T) {
@@ -131,15 +598,1749 @@ func TestLinear(t *testing.T) {
 		Bias: []float64{2, 0, 0},
 	}
 
-	nn := NewHENeuralNet(ctx.Parameters, linearLayer)
+	nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
 	ctx.GenRotationKeys(nn.Rotations())
-	nn.Initialize(ctx.EvaluationKey)
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
 
-	ct := ctx.EncryptInts([]int{1, 1})
-	ct = nn.Infer(ct)
-	pt := ctx.DecryptInts(ct, 3)
+	ct, err := ctx.EncryptInts([]int{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := ctx.DecryptInts(ct, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if !reflect.DeepEqual(pt, []int{5, 7, 11}) {
 		t.Fail()
 	}
+
+	t.Run("Rectangular", func(t *testing.T) {
+		r := rand.New(rand.NewSource(0))
+		for _, shape := range [][2]int{{40, 3}, {3, 40}, {16, 16}} {
+			N, M := shape[0], shape[1]
+			ll := LinearLayer{Weights: make([][]float64, N), Bias: make([]float64, N)}
+			for i := range ll.Weights {
+				ll.Weights[i] = make([]float64, M)
+				for j := range ll.Weights[i] {
+					ll.Weights[i][j] = r.Float64() - 0.5
+				}
+			}
+			msg := make([]float64, M)
+			for i := range msg {
+				msg[i] = r.Float64()
+			}
+
+			// Input is zero padded only if the activation maps zero to zero.
+			for _, act := range []PolyActivation{{Coeffs: []float64{0, 1}}, {Coeffs: []float64{1, 1}}} {
+				nn, err := NewHENeuralNet(ctx.Parameters, act, ll)
+				if err != nil {
+					t.Fatal(err)
+				}
+				el := nn.Layers[1].(EncodedLinearLayer)
+				diags := M
+				if N < M {
+					diags = N
+				}
+				if act.Coeffs[0] == 0 && len(el.Weights.Vec) != diags {
+					t.Fatalf("%d*%d: want %d diagonals, got %d", N, M, diags, len(el.Weights.Vec))
+				}
+				if act.Coeffs[0] != 0 && len(el.Weights.Vec) != N+M-1 {
+					t.Fatalf("%d*%d: want %d diagonals, got %d", N, M, N+M-1, len(el.Weights.Vec))
+				}
+
+				ctx.GenRotationKeys(nn.Rotations())
+				if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+					t.Fatal(err)
+				}
+				plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), act, ll)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := plainNN.Infer(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				ct, err := ctx.EncryptFloats(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ct, err = nn.Infer(ct)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Folded outputs should be masked after N values.
+				got, err := ctx.DecryptFloats(ct, 2*M)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range got {
+					if math.Abs(want[i]-got[i]) > 1e-3 {
+						t.Fatalf("%d*%d: slot %d: want %v, got %v", N, M, i, want[i], got[i])
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("OversizedInput", func(t *testing.T) {
+		// The first layer outputs 40 values, but the second one takes only 16,
+		// so the rest should be ignored instead of replicated.
+		r := rand.New(rand.NewSource(0))
+		randomLinear := func(N, M int) LinearLayer {
+			ll := LinearLayer{Weights: make([][]float64, N), Bias: make([]float64, N)}
+			for i := range ll.Weights {
+				ll.Weights[i] = make([]float64, M)
+				for j := range ll.Weights[i] {
+					ll.Weights[i][j] = r.Float64() - 0.5
+				}
+			}
+			return ll
+		}
+		layers := []Layer{randomLinear(40, 8), randomLinear(3, 16)}
+		msg := make([]float64, 8)
+		for i := range msg {
+			msg[i] = r.Float64()
+		}
+
+		nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el := nn.Layers[1].(EncodedLinearLayer); el.Copies != 0 || el.OutputSize != 0 {
+			t.Fatalf("want diagonal encoding, got %d copies and output size %d", el.Copies, el.OutputSize)
+		}
+
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := plainNN.Infer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloats(ct, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range got {
+			if math.Abs(want[i]-got[i]) > 1e-3 {
+				t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+			}
+		}
+	})
+
+	t.Run("Folded", func(t *testing.T) {
+		ll := LinearLayer{Weights: make([][]float64, 128), Bias: make([]float64, 128)}
+		for i := range ll.Weights {
+			ll.Weights[i] = make([]float64, 784)
+			for j := range ll.Weights[i] {
+				ll.Weights[i][j] = 1
+			}
+		}
+		square := PolyActivation{Coeffs: []float64{0, 0, 1}}
+
+		nn, err := NewHENeuralNet(ctx.Parameters, square, ll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		el := nn.Layers[1].(EncodedLinearLayer)
+		if len(el.Weights.Vec) != 128 || el.OutputSize != 128 {
+			t.Fatalf("want 128 diagonals folded to 128 values, got %d diagonals and %d values", len(el.Weights.Vec), el.OutputSize)
+		}
+		if nn.RequiredDepth() != 3 {
+			t.Fatalf("want depth 3, got %d", nn.RequiredDepth())
+		}
+
+		// Without a spare level, the layer is not folded.
+		layers := []Layer{square}
+		for i := 0; i < ctx.Parameters.MaxLevel()-2; i++ {
+			layers = append(layers, square)
+		}
+		nn, err = NewHENeuralNet(ctx.Parameters, append(layers, ll)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if el := nn.Layers[len(layers)].(EncodedLinearLayer); el.OutputSize != 0 || len(el.Weights.Vec) != 784 {
+			t.Fatalf("want 784 diagonals without folding, got %d diagonals", len(el.Weights.Vec))
+		}
+	})
+}
+
+func TestTiledLinear(t *testing.T) {
+	// Small slots, so that layers span multiple ciphertexts.
+	params := testparams.Small(t)
+	ctx := NewClientContext(params)
+
+	r := rand.New(rand.NewSource(0))
+	randomLinear := func(N, M int) LinearLayer {
+		ll := LinearLayer{Weights: make([][]float64, N), Bias: make([]float64, N)}
+		for i := range ll.Weights {
+			ll.Weights[i] = make([]float64, M)
+			for j := range ll.Weights[i] {
+				ll.Weights[i][j] = (r.Float64() - 0.5) / 10
+			}
+			ll.Bias[i] = r.Float64() - 0.5
+		}
+		return ll
+	}
+	// 300 -> 200 spans 3 input and 2 output ciphertexts, and 200 -> 10 gathers them into one.
+	layers := []Layer{randomLinear(200, 300), Square(), randomLinear(10, 200)}
+	// Zero block from the third input ciphertext is skipped.
+	for i := 0; i < 128; i++ {
+		for j := 256; j < 300; j++ {
+			layers[0].(LinearLayer).Weights[i][j] = 0
+		}
+	}
+
+	nn, err := NewHENeuralNet(params, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nn.Layers[0].(EncodedTiledLinearLayer); !ok {
+		t.Fatalf("want EncodedTiledLinearLayer, got %T", nn.Layers[0])
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(params.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]float64, 300)
+	for i := range msg {
+		msg[i] = r.Float64()
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cts, err := ctx.EncryptFloatsVector(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cts) != 3 {
+		t.Fatalf("want 3 ciphertexts, got %d", len(cts))
+	}
+	cts, err = nn.InferVector(cts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloatsVector(cts, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if math.Abs(want[i]-got[i]) > 1e-3 {
+			t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+
+	t.Run("Marshal", func(t *testing.T) {
+		data, err := nn.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		nn2, _ := NewHENeuralNet(params)
+		if err := nn2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := nn2.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		cts, err := ctx.EncryptFloatsVector(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts, err = nn2.InferVector(cts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got2, err := ctx.DecryptFloatsVector(cts, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range got2 {
+			if math.Abs(want[i]-got2[i]) > 1e-3 {
+				t.Fatalf("slot %d: want %v, got %v", i, want[i], got2[i])
+			}
+		}
+	})
+
+	t.Run("ShapeMismatch", func(t *testing.T) {
+		// Infer returns one ciphertext, but output has 2.
+		nn, err := NewHENeuralNet(params, layers[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		cts, err := ctx.EncryptFloatsVector(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nn.InferVector(cts[:2]); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+		if _, err := nn.Infer(cts[0]); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+		if _, err := nn.tiledLinear(EncodedTiledLinearLayer{}, cts); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		// Batched inputs are encrypted in one ciphertext, so tiled layers cannot be fed.
+		ll := randomLinear(2, params.Slots()/2+10)
+		if _, err := NewBatchedHENeuralNet(params, 2, ll); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("InvalidTileCount", func(t *testing.T) {
+		// 2^32 * 2^32 tiles overflows uint64 to 0.
+		buf := new(bytes.Buffer)
+		writeUint64(buf, 1<<32)
+		writeUint64(buf, 1<<32)
+		buf.Write(make([]byte, 16))
+		var l EncodedTiledLinearLayer
+		if err := l.UnmarshalBinary(buf.Bytes()); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+	})
+}
+
+func TestAvgPool(t *testing.T) {
+	img := make([][]float64, 5)
+	for i := range img {
+		img[i] = make([]float64, 5)
+		for j := range img[i] {
+			img[i][j] = float64(5*i + j + 1)
+		}
+	}
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(5, 5, 2, 1),
+		Kernel: [][][][]float64{
+			{{{1, 0}, {0, 0}}},
+			{{{0, 0}, {0, 1}}},
+		},
+		Bias: []float64{0, 0},
+	}
+	channels, x, y := convLayer.OutputShape()
+	poolLayer := AvgPoolLayer{
+		InputX:   x,
+		InputY:   y,
+		Channels: channels,
+		Window:   2,
+		Stride:   2,
+	}
+
+	nn, err := NewHENeuralNet(ctx.Parameters, convLayer, poolLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := ctx.EncryptIm2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := ctx.DecryptInts(ct, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(pt, []int{4, 6, 14, 16, 10, 12, 20, 22}) {
+		t.Errorf("got %v", pt)
+	}
+
+	t.Run("Reference", func(t *testing.T) {
+		plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), convLayer, poolLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := Im2Col(img, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := plainNN.Infer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range pt {
+			if float64(v) != want[i] {
+				t.Fatalf("slot %d: got %v, want %v", i, v, want[i])
+			}
+		}
+	})
+}
+
+// testLayers returns random conv, square and linear layers for 5*5 image.
+func testLayers(r *rand.Rand) []Layer {
+	kernels := make([][][][]float64, 3)
+	for i := range kernels {
+		kernels[i] = [][][]float64{{
+			{r.Float64(), r.Float64()},
+			{r.Float64(), r.Float64()},
+		}}
+	}
+	weights := make([][]float64, 4)
+	for i := range weights {
+		weights[i] = make([]float64, 3*16)
+		for j := range weights[i] {
+			weights[i][j] = r.Float64() - 0.5
+		}
+	}
+
+	square := ActivationLayer{
+		ActivationFn: func(nn *HENeuralNet, ct *rlwe.Ciphertext) error {
+			nn.Evaluator.MulRelin(ct, ct, ct)
+			return nn.Rescale(ct)
+		},
+		PlaintextFn: func(x float64) float64 { return x * x },
+		Depth:       1,
+	}
+	return []Layer{
+		ConvLayer{
+			ConvSpec: NewConvSpec(5, 5, 2, 1),
+			Kernel:   kernels,
+			Bias:     []float64{0.1, 0.2, 0.3},
+		},
+		square,
+		LinearLayer{
+			Weights: weights,
+			Bias:    []float64{1, 2, 3, 4},
+		},
+	}
+}
+
+// testImage returns random 5*5 image.
+func testImage(r *rand.Rand) [][]float64 {
+	img := make([][]float64, 5)
+	for i := range img {
+		img[i] = make([]float64, 5)
+		for j := range img[i] {
+			img[i][j] = r.Float64()
+		}
+	}
+	return img
+}
+
+func TestReference(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	img := testImage(r)
+	layers := testLayers(r)
+
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := Im2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := ctx.EncryptIm2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err = nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloats(ct, ctx.Parameters.Slots())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range want {
+		if math.Abs(want[i]-got[i]) > 1e-3 {
+			t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+
+	t.Run("MissingPlaintextFn", func(t *testing.T) {
+		square := layers[1].(ActivationLayer)
+		square.PlaintextFn = nil
+		if _, err := NewPlainNeuralNet(ctx.Parameters.Slots(), square); !errors.Is(err, ErrUnsupportedLayer) {
+			t.Fail()
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	batch := 8
+	block := ctx.Parameters.Slots() / batch
+
+	imgs := make([][][]float64, batch)
+	for i := range imgs {
+		imgs[i] = testImage(r)
+	}
+
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(5, 5, 2, 1),
+		Kernel:   make([][][][]float64, 2),
+		Bias:     []float64{r.Float64(), r.Float64()},
+	}
+	for i := range convLayer.Kernel {
+		convLayer.Kernel[i] = [][][]float64{{{r.Float64(), r.Float64()}, {r.Float64(), r.Float64()}}}
+	}
+	channels, x, y := convLayer.OutputShape()
+	featureConvLayer := FeatureConvLayer{
+		ConvSpec: NewConvSpec(x/2, y/2, 2, 1),
+		Kernel:   [][][][]float64{{{{1, 0}, {0, 1}}, {{0, 1}, {1, 0}}}},
+		Bias:     []float64{0.5},
+	}
+
+	for name, layers := range map[string][]Layer{
+		"Linear":      testLayers(r),
+		"FeatureMaps": {convLayer, AvgPoolLayer{InputX: x, InputY: y, Channels: channels, Window: 2, Stride: 2}, featureConvLayer},
+	} {
+		t.Run(name, func(t *testing.T) {
+			nn, err := NewBatchedHENeuralNet(ctx.Parameters, batch, layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nn.Input.Batch != batch {
+				t.Fatalf("Input: %v", nn.Input)
+			}
+			ctx.GenRotationKeys(nn.Rotations())
+			if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+				t.Fatal(err)
+			}
+			plainNN, err := NewPlainNeuralNet(block, layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ct, err := ctx.EncryptIm2ColBatch(imgs, 2, 1, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct, err = nn.Infer(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ctx.DecryptFloatsBatch(ct, batch, block)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for b, img := range imgs {
+				msg, err := Im2Col(img, 2, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := plainNN.Infer(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := range want {
+					if math.Abs(want[i]-got[b][i]) > 1e-3 {
+						t.Fatalf("input %d, slot %d: want %v, got %v", b, i, want[i], got[b][i])
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("EncryptInputBatch", func(t *testing.T) {
+		nn, err := NewBatchedHENeuralNet(ctx.Parameters, batch, testLayers(r)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ctx.EncryptInputBatch(nn.Input, []interface{}{imgs[0], imgs[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloatsBatch(ct, batch, nn.Input.Slots)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for b := 0; b < batch; b++ {
+			want := make([]float64, nn.Input.Slots)
+			if b < 2 {
+				want, _ = Im2Col(imgs[b], 2, 1)
+			}
+			for i := range want {
+				if math.Abs(want[i]-got[b][i]) > 1e-6 {
+					t.Fatalf("input %d, slot %d: want %v, got %v", b, i, want[i], got[b][i])
+				}
+			}
+		}
+
+		if _, err := ctx.EncryptInputBatch(nn.Input, make([]interface{}, batch+1)); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+
+	t.Run("InvalidBatch", func(t *testing.T) {
+		if _, err := NewBatchedHENeuralNet(ctx.Parameters, 3); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+		// 32 slots per block cannot hold Im2Col input of testLayers, which has 64 slots.
+		if _, err := NewBatchedHENeuralNet(ctx.Parameters, ctx.Parameters.Slots()/32, testLayers(r)...); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+}
+
+func TestConcurrentInfer(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	layers := testLayers(r)
+
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nn.Workers = 2
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encryptor and Decryptor are not safe for concurrent use,
+	// so only Infer is called concurrently.
+	N := 8
+	imgs := make([][][]float64, N)
+	cts := make([]*rlwe.Ciphertext, N)
+	for i := range cts {
+		imgs[i] = testImage(r)
+		if cts[i], err = ctx.EncryptIm2Col(imgs[i], 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make([]error, N)
+	var wg sync.WaitGroup
+	for i := range cts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cts[i], errs[i] = nn.Infer(cts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, ct := range cts {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+
+		msg, err := Im2Col(imgs[i], 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := plainNN.Infer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloats(ct, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range got {
+			if math.Abs(want[j]-got[j]) > 1e-3 {
+				t.Fatalf("input %d, slot %d: want %v, got %v", i, j, want[j], got[j])
+			}
+		}
+	}
+}
+
+func TestEvaluationContext(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	layers := testLayers(r)
+
+	// nn is shared by two clients, and never initialized.
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.GenRotationKeys(nn.Rotations())
+	other := NewClientContext(ctx.Parameters)
+	other.GenRotationKeys(nn.Rotations())
+
+	img := testImage(r)
+	msg, err := Im2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []*ClientContext{ctx, other} {
+		ec, err := nn.NewEvaluationContext(c.PublicKeyBundle())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := c.EncryptIm2Col(img, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctOut, err := nn.InferWith(ec, ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.DecryptFloats(ctOut, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range got {
+			if math.Abs(want[j]-got[j]) > 1e-3 {
+				t.Fatalf("client %d, slot %d: want %v, got %v", i, j, want[j], got[j])
+			}
+		}
+	}
+
+	ct, err := ctx.EncryptIm2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nn.Infer(ct); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("want ErrNotInitialized, got %v", err)
+	}
+	if _, err := nn.InferWith(nil, ct); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("want ErrNotInitialized, got %v", err)
+	}
+}
+
+func TestPowerOfTwoRotations(t *testing.T) {
+	slots := ctx.Parameters.Slots()
+
+	t.Run("Compose", func(t *testing.T) {
+		for _, k := range []int{0, 1, -1, 3, 7, -16, 48, 100, slots / 2, -slots / 2, slots - 1, slots + 5} {
+			sum := 0
+			for _, r := range composeRotation(k, slots) {
+				if a := r * sign(r); a&(a-1) != 0 {
+					t.Fatalf("rotation %d: %d is not a power of two", k, r)
+				}
+				sum += r
+			}
+			if ((sum-k)%slots+slots)%slots != 0 {
+				t.Fatalf("rotation %d: composed to %d", k, sum)
+			}
+		}
+	})
+
+	r := rand.New(rand.NewSource(0))
+	layers := testLayers(r)
+
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nn.PowerOfTwoRotations = true
+	nn.Workers = 2
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(slots, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rot := range nn.Rotations() {
+		if a := rot * sign(rot); a&(a-1) != 0 {
+			t.Fatalf("rotation %d is not a power of two", rot)
+		}
+	}
+
+	full, powerOfTwo := nn.RotationTradeoff()
+	if powerOfTwo.Keys != len(nn.Rotations()) || powerOfTwo.Keys >= full.Keys {
+		t.Fatalf("want %d keys fewer than %d, got %d", len(nn.Rotations()), full.Keys, powerOfTwo.Keys)
+	}
+	if powerOfTwo.KeyBytes >= full.KeyBytes || powerOfTwo.KeySwitches < full.KeySwitches {
+		t.Fatalf("unexpected tradeoff: full %+v, power of two %+v", full, powerOfTwo)
+	}
+
+	img := testImage(r)
+	ct, err := ctx.EncryptIm2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctOut, err := nn.Infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := Im2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloats(ctOut, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if math.Abs(want[i]-got[i]) > 1e-3 {
+			t.Fatalf("slot %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+// sign returns the sign of x, and 1 for zero.
+func sign(x int) int {
+	if x < 0 {
+		return -1
+	}
+	return 1
+}
+
+func TestProfile(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	img := testImage(r)
+	layers := testLayers(r)
+
+	nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.GenRotationKeys(nn.Rotations())
+	if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := Im2Col(img, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := ctx.EncryptFloats(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := nn.Profile(ct, ctx.SecretKey, plainNN, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != len(layers) {
+		t.Fatalf("got %d profiles", len(profiles))
+	}
+
+	plans, err := nn.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range profiles {
+		if p.Layer != plans[i].Layer || p.Level != plans[i].LevelOut {
+			t.Errorf("layer %d: got %+v, planned %+v", i, p, plans[i])
+		}
+		if p.MaxError > 1e-3 || p.MeanError > p.MaxError || p.MeanPrecision < 10 {
+			t.Errorf("layer %d: %+v", i, p)
+		}
+	}
+
+	t.Run("MismatchedReference", func(t *testing.T) {
+		plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), layers[:1]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nn.Profile(ct, ctx.SecretKey, plainNN, msg); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+
+	t.Run("NilReference", func(t *testing.T) {
+		if _, err := nn.Profile(ct, ctx.SecretKey, nil, msg); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+	})
+}
+
+func TestActivations(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	N := 32
+
+	msg := make([]float64, N)
+	for i := range msg {
+		msg[i] = 8*r.Float64() - 4
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  func(a, b float64, degree int) (ActivationLayer, error)
+		f    func(float64) float64
+		tol  float64
+	}{
+		{"ReLU", ReLU, func(x float64) float64 { return math.Max(x, 0) }, 0.2},
+		{"Sigmoid", Sigmoid, func(x float64) float64 { return 1 / (1 + math.Exp(-x)) }, 1e-3},
+		{"Tanh", Tanh, math.Tanh, 1e-2},
+		{"GELU", GELU, func(x float64) float64 { return 0.5 * x * (1 + math.Erf(x/math.Sqrt2)) }, 0.2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := tc.new(-4, 4, 15)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Depth != 5 {
+				t.Errorf("Depth: %v", l.Depth)
+			}
+
+			nn, err := NewHENeuralNet(ctx.Parameters, l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx.GenRotationKeys(nn.Rotations())
+			if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+				t.Fatal(err)
+			}
+
+			ct, err := ctx.EncryptFloats(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct, err = nn.Infer(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct.Level() != ctx.Parameters.MaxLevel()-l.Depth {
+				t.Errorf("Level: %v", ct.Level())
+			}
+			got, err := ctx.DecryptFloats(ct, N)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, x := range msg {
+				if math.Abs(got[i]-l.PlaintextFn(x)) > 1e-3 || math.Abs(got[i]-tc.f(x)) > tc.tol {
+					t.Fatalf("f(%v): got %v, want %v", x, got[i], tc.f(x))
+				}
+			}
+		})
+	}
+
+	t.Run("InvalidInterval", func(t *testing.T) {
+		if _, err := ReLU(1, -1, 15); !errors.Is(err, ErrUnsupportedLayer) {
+			t.Fatalf("want ErrUnsupportedLayer, got %v", err)
+		}
+	})
+
+	t.Run("InvalidDegree", func(t *testing.T) {
+		if _, err := ReLU(-4, 4, 1); !errors.Is(err, ErrUnsupportedLayer) {
+			t.Fatalf("want ErrUnsupportedLayer, got %v", err)
+		}
+	})
+
+	t.Run("Degree2", func(t *testing.T) {
+		l, err := Sigmoid(-4, 4, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nn, err := NewHENeuralNet(ctx.Parameters, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloats(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, x := range msg {
+			if math.Abs(got[i]-l.PlaintextFn(x)) > 1e-3 {
+				t.Fatalf("f(%v): got %v, want %v", x, got[i], l.PlaintextFn(x))
+			}
+		}
+	})
+
+	t.Run("IntegerSlope", func(t *testing.T) {
+		// [0, 1] changes variable by 2x - 1, which still consumes one level.
+		l, err := ReLU(0, 1, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nn, err := NewHENeuralNet(ctx.Parameters, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plans, err := nn.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		x := make([]float64, N)
+		for i := range x {
+			x[i] = (msg[i] + 4) / 8
+		}
+		ct, err := ctx.EncryptFloats(x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct.Level() != plans[0].LevelOut {
+			t.Fatalf("want level %d, got %d", plans[0].LevelOut, ct.Level())
+		}
+		got, err := ctx.DecryptFloats(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, x := range x {
+			if math.Abs(got[i]-l.PlaintextFn(x)) > 1e-3 {
+				t.Fatalf("f(%v): got %v, want %v", x, got[i], l.PlaintextFn(x))
+			}
+		}
+	})
+}
+
+func TestPolyActivation(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	N := 32
+
+	msg := make([]float64, N)
+	for i := range msg {
+		msg[i] = 2*r.Float64() - 1
+	}
+
+	for _, tc := range []struct {
+		layer PolyActivation
+		depth int
+	}{
+		{Square(), 1},
+		{PolyActivation{Coeffs: []float64{0.5, 1}}, 1},
+		{PolyActivation{Coeffs: []float64{0, 0, 2}}, 2},
+		{PolyActivation{Coeffs: []float64{0.5, 0.197, 0, -0.004}}, 2},
+		{PolyActivation{Coeffs: []float64{1, 1, 1, 1, 1}}, 3},
+	} {
+		if tc.layer.Depth() != tc.depth {
+			t.Errorf("%v: Depth %v", tc.layer.Coeffs, tc.layer.Depth())
+		}
+
+		nn, err := NewHENeuralNet(ctx.Parameters, tc.layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		plainNN, err := NewPlainNeuralNet(ctx.Parameters.Slots(), tc.layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err = nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct.Level() != ctx.Parameters.MaxLevel()-tc.depth {
+			t.Errorf("%v: Level %v", tc.layer.Coeffs, ct.Level())
+		}
+		got, err := ctx.DecryptFloats(ct, N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := plainNN.Infer(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range got {
+			if math.Abs(got[i]-want[i]) > 1e-3 {
+				t.Fatalf("%v: got %v, want %v", tc.layer.Coeffs, got[i], want[i])
+			}
+		}
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := NewHENeuralNet(ctx.Parameters, PolyActivation{Coeffs: []float64{1, 0}}); !errors.Is(err, ErrUnsupportedLayer) {
+			t.Fail()
+		}
+	})
+}
+
+func TestMarshal(t *testing.T) {
+	img := [][]float64{
+		{1, 2, 3},
+		{4, 5, 6},
+		{7, 8, 9},
+	}
+	kernel := [][]float64{
+		{1, 0},
+		{0, 1},
+	}
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(len(img), len(img[0]), 2, 1),
+		Kernel:   [][][][]float64{{kernel}, {kernel}},
+		Bias:     []float64{0, 1},
+	}
+	linearLayer := LinearLayer{
+		Weights: [][]float64{
+			{1, 0, 0, 0, 1, 0, 0, 0},
+			{0, 1, 0, 0, 0, 1, 0, 0},
+		},
+		Bias: []float64{1, 2},
+	}
+
+	nn, err := NewHENeuralNet(ctx.Parameters, convLayer, Square(), linearLayer, PolyActivation{Coeffs: []float64{1, 0.5, 0.25}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := nn.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		nn2, err := NewHENeuralNet(ctx.Parameters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nn2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(nn.Input, nn2.Input) {
+			t.Fatalf("Input: want %v, got %v", nn.Input, nn2.Input)
+		}
+		// Linear layer has spare levels, so it is folded.
+		if el := nn2.Layers[2].(EncodedLinearLayer); el.OutputSize != 2 || el.Mask == nil {
+			t.Fatalf("OutputSize: want 2, got %d", el.OutputSize)
+		}
+
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+		if err := nn2.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		ct, err := ctx.EncryptIm2Col(img, len(kernel), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctOut, err := nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctOut2, err := nn2.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, _ := ctx.DecryptFloats(ctOut, 2)
+		pt2, _ := ctx.DecryptFloats(ctOut2, 2)
+
+		if !reflect.DeepEqual(pt, pt2) {
+			t.Fail()
+		}
+	})
+
+	t.Run("ParametersMismatch", func(t *testing.T) {
+		params, _ := ckks.NewParametersFromLiteral(ckks.PN13QP218)
+		nn2, _ := NewHENeuralNet(params)
+		if err := nn2.UnmarshalBinary(data); !errors.Is(err, ErrParametersMismatch) {
+			t.Fail()
+		}
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		// Version 1 has convolutions with the wrong bias and mask size.
+		old := append([]byte(nil), data...)
+		old[len(marshalMagic)] = 1
+		nn2, _ := NewHENeuralNet(ctx.Parameters)
+		if err := nn2.UnmarshalBinary(old); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+
+		var l EncodedLinearLayer
+		layerBytes, err := nn.Layers[2].(EncodedLinearLayer).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.unmarshal(layerBytes, 1); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+	})
+
+	t.Run("TrailingData", func(t *testing.T) {
+		nn2, _ := NewHENeuralNet(ctx.Parameters)
+		if err := nn2.UnmarshalBinary(append(append([]byte(nil), data...), 0)); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+
+		for _, l := range nn.Layers {
+			m, ok := l.(interface{ MarshalBinary() ([]byte, error) })
+			if !ok {
+				continue
+			}
+			layerBytes, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			layerBytes = append(layerBytes, 0)
+
+			var err2 error
+			switch l.(type) {
+			case EncodedConvLayer:
+				err2 = new(EncodedConvLayer).UnmarshalBinary(layerBytes)
+			case EncodedLinearLayer:
+				err2 = new(EncodedLinearLayer).UnmarshalBinary(layerBytes)
+			case PolyActivation:
+				err2 = new(PolyActivation).UnmarshalBinary(layerBytes)
+			}
+			if !errors.Is(err2, ErrInvalidEncoding) {
+				t.Fatalf("%T: want ErrInvalidEncoding, got %v", l, err2)
+			}
+		}
+	})
+
+	t.Run("EmptyTiledLinearLayer", func(t *testing.T) {
+		if _, err := (EncodedTiledLinearLayer{}).MarshalBinary(); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+		nn2, _ := NewHENeuralNet(ctx.Parameters)
+		nn2.Layers = []EncodedLayer{EncodedTiledLinearLayer{}}
+		if _, err := nn2.Plan(); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+	})
+}
+
+func TestKeyReport(t *testing.T) {
+	params := testparams.Small(t)
+	ctx := NewClientContext(params)
+
+	rots := []int{1, 2, 3, -5, 64}
+	ctx.GenRotationKeys(rots)
+
+	// Trivial rotations and rotations with the same Galois element need no more keys.
+	r := NewKeyReport(params, append(rots, 0, params.Slots(), 1+params.N()/2))
+	if r.GaloisKeys != len(ctx.RotationKeys.Keys) {
+		t.Fatalf("want %d Galois keys, got %d", len(ctx.RotationKeys.Keys), r.GaloisKeys)
+	}
+	if r.RelinearizationKeyBytes != ctx.RelinearizationKey.MarshalBinarySize() {
+		t.Fatalf("want relinearization key of %d bytes, got %d", ctx.RelinearizationKey.MarshalBinarySize(), r.RelinearizationKeyBytes)
+	}
+	if r.RotationKeyBytes != ctx.RotationKeys.MarshalBinarySize() {
+		t.Fatalf("want rotation keys of %d bytes, got %d", ctx.RotationKeys.MarshalBinarySize(), r.RotationKeyBytes)
+	}
+	if r.TotalBytes != r.RelinearizationKeyBytes+r.RotationKeyBytes {
+		t.Fatalf("want total of %d bytes, got %d", r.RelinearizationKeyBytes+r.RotationKeyBytes, r.TotalBytes)
+	}
+	if r.SeededBytes <= r.TotalBytes/2 || r.SeededBytes >= r.TotalBytes*51/100 {
+		t.Fatalf("want seeded keys of about half of %d bytes, got %d", r.TotalBytes, r.SeededBytes)
+	}
+}
+
+func TestPublicKeyBundle(t *testing.T) {
+	ctx.GenRotationKeys([]int{1, 2, 4})
+	keys := ctx.PublicKeyBundle()
+
+	if err := ctx.CheckBundle(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Marshal", func(t *testing.T) {
+		data, err := keys.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys2 PublicKeyBundle
+		if err := keys2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.CheckBundle(&keys2); err != nil {
+			t.Fatal(err)
+		}
+		if !keys2.Parameters.Equals(keys.Parameters) || len(keys2.RotationKeys.Keys) != len(keys.RotationKeys.Keys) {
+			t.Fail()
+		}
+	})
+
+	t.Run("SecretKey", func(t *testing.T) {
+		leaked := *keys
+		leaked.PublicKey = &rlwe.PublicKey{}
+		leaked.PublicKey.Value[0] = ctx.SecretKey.Value
+		leaked.PublicKey.Value[1] = ctx.PublicKey.Value[1]
+		if err := ctx.CheckBundle(&leaked); err == nil {
+			t.Fail()
+		}
+	})
+}
+
+func TestSeeded(t *testing.T) {
+	params := testparams.Small(t)
+
+	layers := []Layer{LinearLayer{Weights: [][]float64{{1, 2, 3}, {-1, 0, 1}}, Bias: []float64{0.5, -0.5}}, Square()}
+	nn, err := NewHENeuralNet(params, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := NewPlainNeuralNet(params.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewClientContext(params)
+	ctx.GenRotationKeys(nn.Rotations())
+
+	msg := []float64{0.1, 0.2, 0.3}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Bundle", func(t *testing.T) {
+		data, err := ctx.MarshalSeededBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := ctx.PublicKeyBundle().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Both formats have the same header and public key.
+		r := NewKeyReport(params, nn.Rotations())
+		if len(full)-r.TotalBytes != len(data)-r.SeededBytes {
+			t.Fatalf("want seeded bundle of %d bytes, got %d", len(full)-r.TotalBytes+r.SeededBytes, len(data))
+		}
+
+		var keys PublicKeyBundle
+		if err := keys.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := ctx.CheckBundle(&keys); err != nil {
+			t.Fatal(err)
+		}
+		// Keys of ctx are reseeded in place, so both formats carry the same keys.
+		if !keys.RelinearizationKey.Equals(ctx.RelinearizationKey) || !keys.RotationKeys.Equals(ctx.RotationKeys) {
+			t.Fatal("expanded keys differ from the keys of the context")
+		}
+
+		if err := nn.Initialize(&keys); err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctOut, err := nn.Infer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ctx.DecryptFloats(ctOut, len(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if math.Abs(want[i]-got[i]) > 1e-3 {
+				t.Fatalf("output %d: want %v, got %v", i, want[i], got[i])
+			}
+		}
+	})
+
+	t.Run("Ciphertext", func(t *testing.T) {
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fullSize := ct.MarshalBinarySize()
+
+		data, err := ctx.MarshalSeededCiphertext(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) >= fullSize*51/100 {
+			t.Fatalf("want seeded ciphertext of about half of %d bytes, got %d", fullSize, len(data))
+		}
+
+		ct2, err := UnmarshalSeededCiphertext(params, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ct2.Value[0].Equals(ct.Value[0]) || !ct2.Value[1].Equals(ct.Value[1]) || ct2.Scale.Cmp(ct.Scale) != 0 {
+			t.Fatal("expanded ciphertext differs from the reseeded one")
+		}
+		got, err := ctx.DecryptFloats(ct2, len(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range msg {
+			if math.Abs(msg[i]-got[i]) > 1e-3 {
+				t.Fatalf("slot %d: want %v, got %v", i, msg[i], got[i])
+			}
+		}
+	})
+
+	// Encoding again does not reseed with another seed,
+	// which would reveal the secret key with the first encoding.
+	t.Run("Deterministic", func(t *testing.T) {
+		data1, err := ctx.MarshalSeededBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data2, err := ctx.MarshalSeededBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data1, data2) {
+			t.Fatal("seeded bundle differs when encoded again")
+		}
+
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data1, err = ctx.MarshalSeededCiphertext(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data2, err = ctx.MarshalSeededCiphertext(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data1, data2) {
+			t.Fatal("seeded ciphertext differs when encoded again")
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		ct, err := ctx.EncryptFloats(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ctx.MarshalSeededCiphertext(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range [][]byte{nil, data[:len(data)/2], append(data, 0)} {
+			if _, err := UnmarshalSeededCiphertext(params, data); !errors.Is(err, ErrInvalidEncoding) {
+				t.Fatalf("want ErrInvalidEncoding, got %v", err)
+			}
+		}
+
+		keys, err := ctx.MarshalSeededBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b PublicKeyBundle
+		if err := b.UnmarshalBinary(keys[:len(keys)-1]); !errors.Is(err, ErrInvalidEncoding) {
+			t.Fatalf("want ErrInvalidEncoding, got %v", err)
+		}
+	})
+}
+
+func TestErrors(t *testing.T) {
+	linearLayer := LinearLayer{
+		Weights: [][]float64{
+			{1, 2},
+			{3, 4},
+		},
+		Bias: []float64{0, 0},
+	}
+
+	t.Run("NotInitialized", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, _ := ctx.EncryptInts([]int{1, 1})
+		if _, err := nn.Infer(ct); !errors.Is(err, ErrNotInitialized) {
+			t.Fail()
+		}
+	})
+
+	t.Run("ShapeMismatch", func(t *testing.T) {
+		if _, err := ctx.EncryptIm2Col([][]float64{{1, 2, 3}, {4, 5, 6}}, 3, 1); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+
+		convLayer := ConvLayer{
+			ConvSpec: NewConvSpec(3, 3, 2, 1),
+			Kernel:   [][][][]float64{{{{1, 1}, {1, 1}}}},
+			Bias:     []float64{0, 1},
+		}
+		if _, err := NewHENeuralNet(ctx.Parameters, convLayer); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+
+	t.Run("InsufficientLevels", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		ct, _ := ctx.EncryptInts([]int{1, 1})
+		ct.Resize(ct.Degree(), 0)
+		if _, err := nn.Infer(ct); !errors.Is(err, ErrInsufficientLevels) {
+			t.Fail()
+		}
+	})
+
+	t.Run("LevelAboveMaxLevel", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nn.Rotations())
+		if err := nn.Initialize(ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		// Untrusted ciphertexts may have more moduli than the parameters.
+		ct, _ := ctx.EncryptInts([]int{1, 1})
+		for _, p := range ct.Value {
+			p.Coeffs = append(p.Coeffs, make([]uint64, ctx.Parameters.N()))
+		}
+		if _, err := nn.Infer(ct); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+		reference, err := NewPlainNeuralNet(ctx.Parameters.Slots(), linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nn.Profile(ct, ctx.SecretKey, reference, []float64{1, 1}); !errors.Is(err, ErrShapeMismatch) {
+			t.Fatalf("want ErrShapeMismatch, got %v", err)
+		}
+	})
+
+	t.Run("MissingRotationKeys", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.GenRotationKeys(nil)
+		if err := nn.Initialize(ctx.PublicKeyBundle()); !errors.Is(err, ErrInvalidKeys) {
+			t.Fail()
+		}
+	})
+
+	t.Run("NilKeys", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nn.Initialize(nil); !errors.Is(err, ErrInvalidKeys) {
+			t.Fatalf("want ErrInvalidKeys, got %v", err)
+		}
+		if _, err := nn.NewEvaluationContext(nil); !errors.Is(err, ErrInvalidKeys) {
+			t.Fatalf("want ErrInvalidKeys, got %v", err)
+		}
+	})
+
+	t.Run("MissingRelinearizationKey", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := ctx.PublicKeyBundle()
+		keys.RelinearizationKey = nil
+		err = nn.Initialize(keys)
+		if !errors.Is(err, ErrInvalidKeys) {
+			t.Fatalf("want ErrInvalidKeys, got %v", err)
+		}
+		// Validate already wraps ErrInvalidKeys.
+		if want := "invalid keys: missing relinearization key"; err.Error() != want {
+			t.Fatalf("want %q, got %q", want, err.Error())
+		}
+	})
+}
+
+func TestPlan(t *testing.T) {
+	square := ActivationLayer{
+		ActivationFn: func(nn *HENeuralNet, ct *rlwe.Ciphertext) error {
+			nn.Evaluator.MulRelin(ct, ct, ct)
+			return nn.Rescale(ct)
+		},
+		Depth: 1,
+	}
+	convLayer := ConvLayer{
+		ConvSpec: NewConvSpec(3, 3, 2, 1),
+		Kernel:   [][][][]float64{{{{1, 1}, {1, 1}}}},
+		Bias:     []float64{0},
+	}
+	linearLayer := LinearLayer{
+		Weights: [][]float64{{1, 1, 1, 1}},
+		Bias:    []float64{0},
+	}
+
+	t.Run("Levels", func(t *testing.T) {
+		nn, err := NewHENeuralNet(ctx.Parameters, convLayer, square, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nn.RequiredDepth() != 4 {
+			t.Errorf("RequiredDepth: %v", nn.RequiredDepth())
+		}
+
+		plans, err := nn.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxLevel := ctx.Parameters.MaxLevel()
+		levels := [][2]int{{maxLevel, maxLevel - 2}, {maxLevel - 2, maxLevel - 3}, {maxLevel - 3, maxLevel - 4}}
+		for i, p := range plans {
+			if p.LevelIn != levels[i][0] || p.LevelOut != levels[i][1] {
+				t.Errorf("Layer %v: %+v", i, p)
+			}
+		}
+	})
+
+	t.Run("InsufficientLevels", func(t *testing.T) {
+		layers := make([]Layer, ctx.Parameters.MaxLevel()+1)
+		for i := range layers {
+			layers[i] = square
+		}
+		nn, err := NewHENeuralNet(ctx.Parameters, layers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nn.Plan(); !errors.Is(err, ErrInsufficientLevels) {
+			t.Fail()
+		}
+	})
+}
+
+func TestSelectParameters(t *testing.T) {
+	linearLayer := LinearLayer{
+		Weights: make([][]float64, 64),
+		Bias:    make([]float64, 64),
+	}
+	for i := range linearLayer.Weights {
+		linearLayer.Weights[i] = make([]float64, 784)
+	}
+
+	t.Run("Linear", func(t *testing.T) {
+		paramsLiteral, err := SelectParameters([]Layer{linearLayer}, []int{784}, 20, Security128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, err := ckks.NewParametersFromLiteral(paramsLiteral)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if params.Slots() < 784 || params.MaxLevel() < 1 || params.LogQP() > maxLogQP[Security128][params.LogN()] {
+			t.Errorf("Invalid parameters: LogN %v, LogSlots %v, LogQP %v", params.LogN(), params.LogSlots(), params.LogQP())
+		}
+
+		nn, err := NewHENeuralNet(params, linearLayer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := nn.Plan(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ShapeMismatch", func(t *testing.T) {
+		if _, err := SelectParameters([]Layer{linearLayer}, []int{28, 28}, 20, Security128); !errors.Is(err, ErrShapeMismatch) {
+			t.Fail()
+		}
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		if _, err := SelectParameters([]Layer{linearLayer}, []int{784}, 20, SecurityLevel(100)); !errors.Is(err, ErrUnsupportedParameters) {
+			t.Fatalf("want ErrUnsupportedParameters, got %v", err)
+		}
+		if _, err := SelectParameters([]Layer{linearLayer}, []int{784}, 0, Security128); !errors.Is(err, ErrUnsupportedParameters) {
+			t.Fatalf("want ErrUnsupportedParameters, got %v", err)
+		}
+		// Moduli of 11 bits are too small for the primes needed by NTT.
+		if _, err := SelectParameters([]Layer{linearLayer}, []int{784}, 1, Security128); !errors.Is(err, ErrUnsupportedParameters) {
+			t.Fatalf("want ErrUnsupportedParameters, got %v", err)
+		}
+	})
+
+	t.Run("Security", func(t *testing.T) {
+		square := ActivationLayer{Depth: 64}
+		if _, err := SelectParameters([]Layer{linearLayer, square}, []int{784}, 20, Security256); !errors.Is(err, ErrUnsupportedParameters) {
+			t.Fatalf("want ErrUnsupportedParameters, got %v", err)
+		}
+	})
 }
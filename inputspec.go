@@ -0,0 +1,223 @@
+package henn
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Packing is the way the input is packed into the slots of a ciphertext.
+type Packing int
+
+// Supported packings.
+const (
+	// PackingVector packs the input in row-major order.
+	// Used by LinearLayer, FeatureConvLayer and AvgPoolLayer.
+	PackingVector Packing = iota + 1
+	// PackingIm2Col packs the input with Im2Col encoding of ConvSpec.
+	// Used by ConvLayer.
+	PackingIm2Col
+)
+
+// String implements fmt.Stringer.
+func (p Packing) String() string {
+	switch p {
+	case PackingVector:
+		return "vector"
+	case PackingIm2Col:
+		return "im2col"
+	}
+	return fmt.Sprintf("Packing(%d)", int(p))
+}
+
+// InputSpec describes the input expected by HENeuralNet.
+// Server can send it to the client,
+// so that the client encodes the input with EncryptInput without knowing the model.
+type InputSpec struct {
+	Packing Packing
+	// Shape is (C, X, Y) for images and feature maps, and (M) for vectors.
+	Shape []int
+	// Conv is the geometry of Im2Col encoding, only used for PackingIm2Col.
+	Conv ConvSpec
+	// Slots is the number of slots used by the encoded input.
+	Slots int
+	// Batch is the number of inputs packed in one ciphertext.
+	// See HENeuralNet.Batch. Zero is the same as one.
+	Batch int
+}
+
+// blockSize returns the number of slots for each input,
+// when the ciphertext has slots slots.
+func (s InputSpec) blockSize(slots int) int {
+	if s.Batch <= 1 {
+		return slots
+	}
+	return slots / s.Batch
+}
+
+// inputSpec returns the InputSpec of l as the first layer,
+// and false if l does not determine the input.
+func inputSpec(l Layer) (InputSpec, bool) {
+	switch l := l.(type) {
+	case ConvLayer:
+		c, _, _ := l.kernelShape()
+		kSize, repeat := l.im2ColSize()
+		return InputSpec{Packing: PackingIm2Col, Shape: []int{c, l.InputX, l.InputY}, Conv: l.ConvSpec, Slots: kSize * repeat}, true
+	case FeatureConvLayer:
+		c, _, _ := ConvLayer(l).kernelShape()
+		return InputSpec{Packing: PackingVector, Shape: []int{c, l.InputX, l.InputY}, Slots: c * l.InputX * l.InputY}, true
+	case AvgPoolLayer:
+		return InputSpec{Packing: PackingVector, Shape: []int{l.Channels, l.InputX, l.InputY}, Slots: l.Channels * l.InputX * l.InputY}, true
+	case LinearLayer:
+		return InputSpec{Packing: PackingVector, Shape: []int{len(l.Weights[0])}, Slots: len(l.Weights[0])}, true
+	}
+	return InputSpec{}, false
+}
+
+// Encode encodes data as the message of the ciphertext, following this InputSpec.
+// data should be []float64 for the shape (M),
+// [][][]float64 for the shape (C, X, Y), or [][]float64 for the shape (1, X, Y).
+// It returns ErrShapeMismatch if data does not have the shape of this InputSpec.
+func (s InputSpec) Encode(data interface{}) ([]float64, error) {
+	var img [][][]float64
+	switch data := data.(type) {
+	case []float64:
+		if len(s.Shape) != 1 || len(data) != s.Shape[0] {
+			return nil, fmt.Errorf("%w: input of length %d does not match shape %v", ErrShapeMismatch, len(data), s.Shape)
+		}
+		if s.Packing != PackingVector {
+			return nil, fmt.Errorf("%w: unsupported packing %v for vector input", ErrShapeMismatch, s.Packing)
+		}
+		return data, nil
+	case [][]float64:
+		img = [][][]float64{data}
+	case [][][]float64:
+		img = data
+	default:
+		return nil, fmt.Errorf("%w: unsupported input type %T", ErrShapeMismatch, data)
+	}
+
+	if len(s.Shape) != 3 || len(img) != s.Shape[0] {
+		return nil, fmt.Errorf("%w: input does not match shape %v", ErrShapeMismatch, s.Shape)
+	}
+	for _, ch := range img {
+		if len(ch) != s.Shape[1] {
+			return nil, fmt.Errorf("%w: input does not match shape %v", ErrShapeMismatch, s.Shape)
+		}
+		for _, row := range ch {
+			if len(row) != s.Shape[2] {
+				return nil, fmt.Errorf("%w: input does not match shape %v", ErrShapeMismatch, s.Shape)
+			}
+		}
+	}
+
+	switch s.Packing {
+	case PackingVector:
+		msg := make([]float64, 0, s.Slots)
+		for _, ch := range img {
+			for _, row := range ch {
+				msg = append(msg, row...)
+			}
+		}
+		return msg, nil
+	case PackingIm2Col:
+		if s.Conv.InputX != s.Shape[1] || s.Conv.InputY != s.Shape[2] {
+			return nil, fmt.Errorf("%w: ConvSpec does not match shape %v", ErrShapeMismatch, s.Shape)
+		}
+		return s.Conv.Im2Col(img)
+	}
+	return nil, fmt.Errorf("%w: unsupported packing %v", ErrShapeMismatch, s.Packing)
+}
+
+// EncryptInput encodes data following spec, and encrypts it.
+// spec is usually the Input of HENeuralNet, sent from the server.
+// See InputSpec.Encode for the type of data.
+// If spec is batched, data is placed at the first block.
+func (ctx *EncryptionContext) EncryptInput(spec InputSpec, data interface{}) (*rlwe.Ciphertext, error) {
+	return ctx.EncryptInputBatch(spec, []interface{}{data})
+}
+
+// EncryptInputBatch encodes each input of data following spec, and encrypts them in one ciphertext.
+// Input i is placed at the block i, and data can have at most spec.Batch inputs.
+func (ctx *EncryptionContext) EncryptInputBatch(spec InputSpec, data []interface{}) (*rlwe.Ciphertext, error) {
+	if spec.Batch < 0 || spec.Batch > ctx.Parameters.Slots() || (spec.Batch > 0 && ctx.Parameters.Slots()%spec.Batch != 0) {
+		return nil, fmt.Errorf("%w: invalid batch %d", ErrShapeMismatch, spec.Batch)
+	}
+	block := spec.blockSize(ctx.Parameters.Slots())
+	if spec.Slots > block {
+		return nil, fmt.Errorf("%w: input of %d slots does not fit in %d slots", ErrShapeMismatch, spec.Slots, block)
+	}
+
+	msgs := make([][]float64, len(data))
+	for i, d := range data {
+		msg, err := spec.Encode(d)
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		if len(msg) != spec.Slots {
+			return nil, fmt.Errorf("input %d: %w: encoded input has %d slots, but spec has %d slots", i, ErrShapeMismatch, len(msg), spec.Slots)
+		}
+		msgs[i] = msg
+	}
+	return ctx.encryptBatch(msgs, block)
+}
+
+// MarshalBinary encodes InputSpec to bytes.
+func (s InputSpec) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writeUint64(buf, uint64(s.Packing))
+	writeUint64(buf, uint64(len(s.Shape)))
+	for _, n := range s.Shape {
+		writeUint64(buf, uint64(n))
+	}
+	for _, n := range []int{
+		s.Conv.InputX, s.Conv.InputY,
+		s.Conv.KernelX, s.Conv.KernelY,
+		s.Conv.StrideX, s.Conv.StrideY,
+		s.Conv.Padding.Top, s.Conv.Padding.Bottom, s.Conv.Padding.Left, s.Conv.Padding.Right,
+	} {
+		writeUint64(buf, uint64(n))
+	}
+	if s.Conv.Padding.Same {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	writeUint64(buf, uint64(s.Slots))
+	writeUint64(buf, uint64(s.Batch))
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to InputSpec.
+func (s *InputSpec) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	spec := InputSpec{Packing: Packing(d.uint64())}
+
+	dims := d.uint64()
+	if d.err == nil && dims > uint64(len(d.data))/8 {
+		return fmt.Errorf("%w: invalid shape", ErrInvalidEncoding)
+	}
+	for i := uint64(0); i < dims && d.err == nil; i++ {
+		spec.Shape = append(spec.Shape, int(d.uint64()))
+	}
+
+	for _, n := range []*int{
+		&spec.Conv.InputX, &spec.Conv.InputY,
+		&spec.Conv.KernelX, &spec.Conv.KernelY,
+		&spec.Conv.StrideX, &spec.Conv.StrideY,
+		&spec.Conv.Padding.Top, &spec.Conv.Padding.Bottom, &spec.Conv.Padding.Left, &spec.Conv.Padding.Right,
+	} {
+		*n = int(d.uint64())
+	}
+	spec.Conv.Padding.Same = d.byte() == 1
+	spec.Slots = int(d.uint64())
+	spec.Batch = int(d.uint64())
+
+	if err := d.close(); err != nil {
+		return err
+	}
+
+	*s = spec
+	return nil
+}
@@ -0,0 +1,25 @@
+// Package testparams provides the CKKS parameters shared by tests.
+package testparams
+
+import (
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+)
+
+// Small returns small parameters for tests, with 128 slots and 3 levels.
+// They are fast, but not secure.
+func Small(t testing.TB) ckks.Parameters {
+	t.Helper()
+	params, err := ckks.NewParametersFromLiteral(ckks.ParametersLiteral{
+		LogN:         12,
+		LogSlots:     7,
+		LogQ:         []int{45, 30, 30, 30},
+		LogP:         []int{45},
+		DefaultScale: 1 << 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
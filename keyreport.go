@@ -0,0 +1,86 @@
+package henn
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// relinearizationDegree is the maximum degree of the relinearization key generated by ClientContext.
+const relinearizationDegree = 2
+
+// seedSize is the size of the seed that replaces the uniformly random half of seeded keys.
+const seedSize = 32
+
+// KeyReport reports the size of evaluation keys the client uploads to the server.
+// Sizes follow the serialization of Lattigo, which is used by PublicKeyBundle.
+type KeyReport struct {
+	// GaloisKeys is the number of rotation keys, one for each distinct Galois element.
+	GaloisKeys int
+	// KeyBytes is the size of one rotation key in bytes.
+	KeyBytes int
+
+	// RelinearizationKeyBytes is the size of the relinearization key in bytes.
+	RelinearizationKeyBytes int
+	// RotationKeyBytes is the size of all rotation keys in bytes.
+	RotationKeyBytes int
+	// TotalBytes is the sum of RelinearizationKeyBytes and RotationKeyBytes.
+	TotalBytes int
+
+	// SeededBytes is TotalBytes in the seeded format of ClientContext.MarshalSeededBundle,
+	// where the uniformly random half of every key is replaced by the seed it is generated from.
+	SeededBytes int
+}
+
+// NewKeyReport returns the KeyReport of evaluation keys for params and rotations rots,
+// as generated by ClientContext.GenRotationKeys.
+// Usually, rots is HENeuralNet.Rotations().
+// Rotations by multiples of Slots need no keys, and rotations with the same Galois element share one key.
+func NewKeyReport(params ckks.Parameters, rots []int) KeyReport {
+	galEls := make(map[uint64]struct{})
+	for _, rot := range rots {
+		if rot%params.Slots() != 0 {
+			galEls[params.GaloisElementForColumnRotationBy(rot)] = struct{}{}
+		}
+	}
+
+	swk := rlwe.NewSwitchingKey(params.Parameters, params.QCount()-1, params.PCount()-1)
+	keyBytes := swk.MarshalBinarySize()
+	seeded := new(bytes.Buffer)
+	encodeSeededSwitchingKey(seeded, swk, make([]byte, seedSize))
+	seededKeyBytes := seeded.Len()
+
+	r := KeyReport{
+		GaloisKeys: len(galEls),
+		KeyBytes:   keyBytes,
+
+		// Following MarshalBinary of RelinearizationKey and RotationKeySet in Lattigo.
+		RelinearizationKeyBytes: 1 + relinearizationDegree*keyBytes,
+		RotationKeyBytes:        len(galEls) * (8 + keyBytes),
+	}
+	r.TotalBytes = r.RelinearizationKeyBytes + r.RotationKeyBytes
+	// Following MarshalSeededBundle.
+	r.SeededBytes = 8 + relinearizationDegree*seededKeyBytes + 8 + len(galEls)*(8+seededKeyBytes)
+
+	return r
+}
+
+// String implements fmt.Stringer.
+func (r KeyReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Galois keys:         %d\n", r.GaloisKeys)
+	fmt.Fprintf(&b, "Bytes per key:       %s\n", formatBytes(r.KeyBytes))
+	fmt.Fprintf(&b, "Relinearization key: %s\n", formatBytes(r.RelinearizationKeyBytes))
+	fmt.Fprintf(&b, "Rotation keys:       %s\n", formatBytes(r.RotationKeyBytes))
+	fmt.Fprintf(&b, "Total:               %s\n", formatBytes(r.TotalBytes))
+	fmt.Fprintf(&b, "Total (seeded):      %s\n", formatBytes(r.SeededBytes))
+	return b.String()
+}
+
+// formatBytes formats n bytes in megabytes.
+func formatBytes(n int) string {
+	return fmt.Sprintf("%.2f MB (%d bytes)", float64(n)/1e6, n)
+}
@@ -1,6 +1,9 @@
 package henn
 
 import (
+	"fmt"
+	"math/bits"
+
 	"github.com/tuneinsight/lattigo/v4/ckks"
 	"github.com/tuneinsight/lattigo/v4/rlwe"
 )
@@ -11,19 +14,178 @@ type Layer interface {
 }
 
 // ConvLayer represents the convolution layer.
+// ConvSpec describes the input size, kernel size, strides and padding,
+// and Kernel has shape (output channels, input channels, KernelX, KernelY).
+// Input should be encrypted with EncryptIm2ColSpec with the same ConvSpec.
 type ConvLayer struct {
-	InputX int
-	InputY int
+	ConvSpec
 
-	Kernel [][][]float64
+	Kernel [][][][]float64
 	Bias   []float64
-	Stride int
 }
 
 // isLayer implements Layer interface.
 func (ConvLayer) isLayer() {}
 
+// kernelShape returns the shape of a kernel,
+// which is (input channels, kx, ky).
+func (cl ConvLayer) kernelShape() (int, int, int) {
+	return len(cl.Kernel[0]), len(cl.Kernel[0][0]), len(cl.Kernel[0][0][0])
+}
+
+// im2ColSize returns the size of Im2Col encoded input,
+// which is (kernel size times input channels, number of windows).
+func (cl ConvLayer) im2ColSize() (int, int) {
+	c, kx, ky := cl.kernelShape()
+	outX, outY := cl.OutputSize()
+	return c * kx * ky, outX * outY
+}
+
+// check checks if this ConvLayer is well-formed, and fits in slots.
+func (cl ConvLayer) check(slots int) error {
+	if err := cl.checkKernel(); err != nil {
+		return err
+	}
+
+	kSize, repeat := cl.im2ColSize()
+	if kSize*repeat > slots || len(cl.Kernel)*repeat > slots {
+		return fmt.Errorf("%w: convolution does not fit in %d slots", ErrShapeMismatch, slots)
+	}
+
+	return nil
+}
+
+// checkKernel checks if kernels and bias are well-formed,
+// and match ConvSpec.
+func (cl ConvLayer) checkKernel() error {
+	if err := cl.ConvSpec.check(); err != nil {
+		return err
+	}
+
+	if len(cl.Kernel) == 0 || len(cl.Kernel) != len(cl.Bias) {
+		return fmt.Errorf("%w: dimension mismatch between kernel and bias", ErrShapeMismatch)
+	}
+	if len(cl.Kernel[0]) == 0 {
+		return fmt.Errorf("%w: empty kernel", ErrShapeMismatch)
+	}
+
+	c := len(cl.Kernel[0])
+	for _, k := range cl.Kernel {
+		if len(k) != c {
+			return fmt.Errorf("%w: kernels have different number of channels", ErrShapeMismatch)
+		}
+		for _, kc := range k {
+			if len(kc) != cl.KernelX {
+				return fmt.Errorf("%w: kernel size does not match %d*%d", ErrShapeMismatch, cl.KernelX, cl.KernelY)
+			}
+			for _, row := range kc {
+				if len(row) != cl.KernelY {
+					return fmt.Errorf("%w: kernel size does not match %d*%d", ErrShapeMismatch, cl.KernelX, cl.KernelY)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// flattenKernel flattens k in the order of Im2Col encoding,
+// which is input channel, then row, then column.
+func flattenKernel(k [][][]float64) []float64 {
+	flattened := make([]float64, 0, len(k)*len(k[0])*len(k[0][0]))
+	for _, kc := range k {
+		for _, row := range kc {
+			flattened = append(flattened, row...)
+		}
+	}
+	return flattened
+}
+
+// OutputShape returns the shape of the output of this ConvLayer,
+// which is (channels, X, Y).
+// Channel i is placed at i * X * Y, and each feature map is in row-major order.
+func (cl ConvLayer) OutputShape() (int, int, int) {
+	outX, outY := cl.OutputSize()
+	return len(cl.Kernel), outX, outY
+}
+
+// FeatureConvLayer represents the convolution layer on encrypted feature maps.
+// Unlike ConvLayer, input is not Im2Col encoded:
+// it should have the layout of the output of ConvLayer,
+// where input channel i of size InputX * InputY is placed at i * InputX * InputY.
+// Therefore, it can follow ConvLayer, AvgPoolLayer, or another FeatureConvLayer.
+// Output has the same layout.
+//
+// Kernel has shape (output channels, input channels, KernelX, KernelY).
+// It is encoded as EncodedLinearLayer.
+type FeatureConvLayer struct {
+	ConvSpec
+
+	Kernel [][][][]float64
+	Bias   []float64
+}
+
+// isLayer implements Layer interface.
+func (FeatureConvLayer) isLayer() {}
+
+// OutputShape returns the shape of the output of this FeatureConvLayer,
+// which is (channels, X, Y).
+func (fl FeatureConvLayer) OutputShape() (int, int, int) {
+	return ConvLayer(fl).OutputShape()
+}
+
+// check checks if this FeatureConvLayer is well-formed, and fits in slots.
+func (fl FeatureConvLayer) check(slots int) error {
+	if err := ConvLayer(fl).checkKernel(); err != nil {
+		return err
+	}
+
+	c, _, _ := ConvLayer(fl).kernelShape()
+	outC, outX, outY := fl.OutputShape()
+	if c*fl.InputX*fl.InputY > slots || outC*outX*outY > slots {
+		return fmt.Errorf("%w: convolution does not fit in %d slots", ErrShapeMismatch, slots)
+	}
+
+	return nil
+}
+
+// AvgPoolLayer represents the average pooling layer.
+// Input should have the layout of the output of ConvLayer:
+// Channels feature maps of size InputX * InputY, where channel i is placed at i * InputX * InputY.
+// Output has the same layout, so it can be followed by another AvgPoolLayer.
+type AvgPoolLayer struct {
+	InputX   int
+	InputY   int
+	Channels int
+
+	Window int
+	Stride int
+}
+
+// isLayer implements Layer interface.
+func (AvgPoolLayer) isLayer() {}
+
+// OutputShape returns the shape of the output of this AvgPoolLayer,
+// which is (channels, X, Y).
+func (pl AvgPoolLayer) OutputShape() (int, int, int) {
+	return pl.Channels, (pl.InputX-pl.Window)/pl.Stride + 1, (pl.InputY-pl.Window)/pl.Stride + 1
+}
+
+// check checks if this AvgPoolLayer is well-formed, and fits in slots.
+func (pl AvgPoolLayer) check(slots int) error {
+	if pl.Channels <= 0 || pl.Window <= 0 || pl.Stride <= 0 || pl.InputX < pl.Window || pl.InputY < pl.Window {
+		return fmt.Errorf("%w: input size %d*%d*%d does not fit window %d with stride %d", ErrShapeMismatch, pl.Channels, pl.InputX, pl.InputY, pl.Window, pl.Stride)
+	}
+	if pl.Channels*pl.InputX*pl.InputY > slots {
+		return fmt.Errorf("%w: pooling does not fit in %d slots", ErrShapeMismatch, slots)
+	}
+
+	return nil
+}
+
 // LinearLayer represents the linear layer.
+// If the input or output does not fit in one ciphertext,
+// it is tiled across multiple ciphertexts as EncodedTiledLinearLayer.
 type LinearLayer struct {
 	Weights [][]float64
 	Bias    []float64
@@ -32,9 +194,56 @@ type LinearLayer struct {
 // isLayer implements Layer interface.
 func (LinearLayer) isLayer() {}
 
+// check checks if this LinearLayer is well-formed, and fits in slots.
+func (ll LinearLayer) check(slots int) error {
+	if err := ll.checkWeights(); err != nil {
+		return err
+	}
+
+	N, M := len(ll.Weights), len(ll.Weights[0])
+	if N > slots || M > slots {
+		return fmt.Errorf("%w: %d*%d weights do not fit in %d slots", ErrShapeMismatch, N, M, slots)
+	}
+
+	return nil
+}
+
+// checkWeights checks if weights and bias of this LinearLayer are well-formed.
+func (ll LinearLayer) checkWeights() error {
+	N := len(ll.Weights)
+	if N == 0 || len(ll.Bias) != N {
+		return fmt.Errorf("%w: dimension mismatch between weights and bias", ErrShapeMismatch)
+	}
+	M := len(ll.Weights[0])
+	if M == 0 {
+		return fmt.Errorf("%w: empty weights", ErrShapeMismatch)
+	}
+	for _, row := range ll.Weights {
+		if len(row) != M {
+			return fmt.Errorf("%w: weights have different row sizes", ErrShapeMismatch)
+		}
+	}
+
+	return nil
+}
+
+// tiles returns the number of ciphertexts of the input and output of this LinearLayer,
+// where each ciphertext holds tile values.
+func (ll LinearLayer) tiles(tile int) (int, int) {
+	return (len(ll.Weights[0]) + tile - 1) / tile, (len(ll.Weights) + tile - 1) / tile
+}
+
 // ActivationLayer represents the activation layer.
+// ActivationFn is applied in-place to the ciphertext,
+// and Depth is the number of levels it consumes.
+// PlaintextFn is the same function on cleartext, which is used by PlainNeuralNet.
+// Name is used to identify this layer when serializing HENeuralNet.
+// See RegisterActivation.
 type ActivationLayer struct {
-	ActivationFn func(*HENeuralNet, *rlwe.Ciphertext)
+	Name         string
+	ActivationFn func(*HENeuralNet, *rlwe.Ciphertext) error
+	PlaintextFn  func(float64) float64
+	Depth        int
 }
 
 // isLayer implements Layer interface.
@@ -43,6 +252,58 @@ func (ActivationLayer) isLayer() {}
 // isEncodedLayer implements EncodedLayer interface.
 func (ActivationLayer) isEncodedLayer() {}
 
+// PolyActivation represents the polynomial activation layer,
+// which evaluates Coeffs[0] + Coeffs[1] * x + ... + Coeffs[d] * x^d.
+// Unlike ActivationLayer, it is a plain data,
+// so it can be serialized without registration.
+type PolyActivation struct {
+	Coeffs []float64
+}
+
+// Square returns PolyActivation of x^2.
+func Square() PolyActivation {
+	return PolyActivation{Coeffs: []float64{0, 0, 1}}
+}
+
+// isLayer implements Layer interface.
+func (PolyActivation) isLayer() {}
+
+// isEncodedLayer implements EncodedLayer interface.
+func (PolyActivation) isEncodedLayer() {}
+
+// check checks if this PolyActivation is well-formed.
+func (pa PolyActivation) check() error {
+	if len(pa.Coeffs) < 2 || pa.Coeffs[len(pa.Coeffs)-1] == 0 {
+		return fmt.Errorf("%w: polynomial should have nonzero leading coefficient and degree at least 1", ErrUnsupportedLayer)
+	}
+	return nil
+}
+
+// isSquare returns true if this PolyActivation is exactly x^2,
+// which can be evaluated with one multiplication.
+func (pa PolyActivation) isSquare() bool {
+	return len(pa.Coeffs) == 3 && pa.Coeffs[0] == 0 && pa.Coeffs[1] == 0 && pa.Coeffs[2] == 1
+}
+
+// Depth returns the number of levels consumed by this PolyActivation.
+// x^2 consumes one level, and other polynomials consume ceil(log2(d+1)) levels,
+// following ckks.Evaluator.EvaluatePoly.
+func (pa PolyActivation) Depth() int {
+	if pa.isSquare() {
+		return 1
+	}
+	return bits.Len(uint(len(pa.Coeffs) - 1))
+}
+
+// evaluate evaluates this polynomial on x.
+func (pa PolyActivation) evaluate(x float64) float64 {
+	v := 0.0
+	for i := len(pa.Coeffs) - 1; i >= 0; i-- {
+		v = v*x + pa.Coeffs[i]
+	}
+	return v
+}
+
 // EncodedLayer represents the encoded layers that can be directly used in HENeuralNets.
 type EncodedLayer interface {
 	isEncodedLayer()
@@ -63,10 +324,41 @@ type EncodedConvLayer struct {
 func (EncodedConvLayer) isEncodedLayer() {}
 
 // EncodedLinearLayer represents the encoded linear layer.
+// If Copies > 1, Weights are encoded with the rectangular encoding,
+// and the input of InputSize values is replicated Copies times before Weights are applied.
+// If OutputSize > 0, Weights are encoded with the folded encoding,
+// and the output is folded to OutputSize values, which are kept by Mask.
 type EncodedLinearLayer struct {
 	Weights ckks.LinearTransform
 	Bias    *rlwe.Plaintext
+
+	InputSize int
+	Copies    int
+
+	OutputSize int
+	Mask       *rlwe.Plaintext
 }
 
 // isEncodedLayer implements EncodedLayer interface.
 func (EncodedLinearLayer) isEncodedLayer() {}
+
+// EncodedTiledLinearLayer represents the encoded linear layer,
+// whose input or output does not fit in one ciphertext.
+// The weights are split into blocks, where Weights[i][j] maps the input ciphertext j
+// to the output ciphertext i, and the outputs are accumulated across input ciphertexts.
+// Zero blocks have no diagonals, and are skipped.
+type EncodedTiledLinearLayer struct {
+	Weights [][]ckks.LinearTransform
+	Bias    []*rlwe.Plaintext
+}
+
+// isEncodedLayer implements EncodedLayer interface.
+func (EncodedTiledLinearLayer) isEncodedLayer() {}
+
+// EncodedAvgPoolLayer represents the encoded average pooling layer.
+type EncodedAvgPoolLayer struct {
+	Weights ckks.LinearTransform
+}
+
+// isEncodedLayer implements EncodedLayer interface.
+func (EncodedAvgPoolLayer) isEncodedLayer() {}
@@ -0,0 +1,637 @@
+package henn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe/ringqp"
+)
+
+// marshalMagic is written at the start of every serialized HENeuralNet.
+var marshalMagic = []byte("HENN")
+
+// marshalVersion is the version of the serialization format.
+// Version 1 encoded the bias and mask of EncodedConvLayer with the wrong size,
+// so it is not supported.
+const marshalVersion = 2
+
+// Tags for serialized layers.
+const (
+	tagConvLayer byte = iota + 1
+	tagLinearLayer
+	tagActivationLayer
+	tagPolyActivation
+	tagAvgPoolLayer
+	tagTiledLinearLayer
+)
+
+// activationRegistry stores ActivationLayers that can be restored by name.
+var activationRegistry = make(map[string]ActivationLayer)
+
+// RegisterActivation registers ActivationLayer by its name,
+// so that HENeuralNets containing it can be serialized.
+// This should be called in init(), like gob.Register.
+func RegisterActivation(l ActivationLayer) {
+	if l.Name == "" {
+		panic("cannot register unnamed activation")
+	}
+	if _, ok := activationRegistry[l.Name]; ok {
+		panic(fmt.Sprintf("activation %q already registered", l.Name))
+	}
+	activationRegistry[l.Name] = l
+}
+
+// MarshalBinary encodes this HENeuralNet to bytes.
+// The header records the parameters, so that the model cannot be loaded against different ones.
+// Evaluation keys are not included.
+func (nn *HENeuralNet) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.Write(marshalMagic)
+	buf.WriteByte(marshalVersion)
+
+	paramsBytes, err := nn.Parameters.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	writeBytes(buf, paramsBytes)
+
+	inputBytes, err := nn.Input.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	writeBytes(buf, inputBytes)
+
+	writeUint64(buf, uint64(len(nn.Layers)))
+	for _, l := range nn.Layers {
+		var tag byte
+		var layerBytes []byte
+
+		switch l := l.(type) {
+		case EncodedConvLayer:
+			tag = tagConvLayer
+			layerBytes, err = l.MarshalBinary()
+		case EncodedLinearLayer:
+			tag = tagLinearLayer
+			layerBytes, err = l.MarshalBinary()
+		case ActivationLayer:
+			if _, ok := activationRegistry[l.Name]; !ok {
+				return nil, fmt.Errorf("%w: cannot marshal unregistered activation %q", ErrUnsupportedLayer, l.Name)
+			}
+			tag = tagActivationLayer
+			layerBytes = []byte(l.Name)
+		case PolyActivation:
+			tag = tagPolyActivation
+			layerBytes, err = l.MarshalBinary()
+		case EncodedAvgPoolLayer:
+			tag = tagAvgPoolLayer
+			layerBytes, err = l.MarshalBinary()
+		case EncodedTiledLinearLayer:
+			tag = tagTiledLinearLayer
+			layerBytes, err = l.MarshalBinary()
+		default:
+			return nil, fmt.Errorf("%w: cannot marshal layer of type %T", ErrUnsupportedLayer, l)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf.WriteByte(tag)
+		writeBytes(buf, layerBytes)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to this HENeuralNet.
+// If nn already has parameters, they should match the parameters of the encoded model.
+// Otherwise, parameters are also restored.
+//
+// After unmarshaling, you should call Initialize to use this NN.
+func (nn *HENeuralNet) UnmarshalBinary(data []byte) (err error) {
+	defer recoverError(&err, ErrInvalidEncoding)
+
+	if len(data) < len(marshalMagic)+1 || !bytes.Equal(data[:len(marshalMagic)], marshalMagic) {
+		return fmt.Errorf("%w: invalid header", ErrInvalidEncoding)
+	}
+	version := data[len(marshalMagic)]
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data[len(marshalMagic)+1:]}
+
+	var params ckks.Parameters
+	paramsBytes := d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if err := params.UnmarshalBinary(paramsBytes); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	if nn.Parameters.LogN() != 0 && !nn.Parameters.Equals(params) {
+		return ErrParametersMismatch
+	}
+
+	var input InputSpec
+	inputBytes := d.bytes()
+	if d.err != nil {
+		return d.err
+	}
+	if err := input.UnmarshalBinary(inputBytes); err != nil {
+		return err
+	}
+
+	layerCount := d.uint64()
+	layers := make([]EncodedLayer, 0)
+	for i := uint64(0); i < layerCount && d.err == nil; i++ {
+		tag := d.byte()
+		layerBytes := d.bytes()
+		if d.err != nil {
+			break
+		}
+
+		switch tag {
+		case tagConvLayer:
+			var l EncodedConvLayer
+			if err := l.unmarshal(layerBytes, version); err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		case tagLinearLayer:
+			var l EncodedLinearLayer
+			if err := l.unmarshal(layerBytes, version); err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		case tagActivationLayer:
+			l, ok := activationRegistry[string(layerBytes)]
+			if !ok {
+				return fmt.Errorf("%w: unregistered activation %q", ErrUnsupportedLayer, layerBytes)
+			}
+			layers = append(layers, l)
+		case tagPolyActivation:
+			var l PolyActivation
+			if err := l.unmarshal(layerBytes, version); err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		case tagAvgPoolLayer:
+			var l EncodedAvgPoolLayer
+			if err := l.unmarshal(layerBytes, version); err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		case tagTiledLinearLayer:
+			var l EncodedTiledLinearLayer
+			if err := l.unmarshal(layerBytes, version); err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		default:
+			return fmt.Errorf("%w: unknown layer tag %d", ErrInvalidEncoding, tag)
+		}
+	}
+	if err := d.close(); err != nil {
+		return err
+	}
+
+	nn.Parameters = params
+	nn.Encoder = ckks.NewEncoder(params)
+	nn.Evaluator = nil
+	nn.eval = nil
+	nn.Layers = layers
+	nn.Input = input
+	nn.Batch = input.Batch
+	if nn.Batch == 0 {
+		nn.Batch = 1
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes EncodedConvLayer to bytes.
+func (l EncodedConvLayer) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writeUint64(buf, uint64(l.Im2ColX))
+	writeUint64(buf, uint64(l.Im2ColY))
+	writeUint64(buf, uint64(l.Stride))
+
+	if err := writePlaintext(buf, l.mask); err != nil {
+		return nil, err
+	}
+
+	writeUint64(buf, uint64(len(l.Kernel)))
+	for i := range l.Kernel {
+		if err := writePlaintext(buf, l.Kernel[i]); err != nil {
+			return nil, err
+		}
+		if err := writePlaintext(buf, l.Bias[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to EncodedConvLayer.
+func (l *EncodedConvLayer) UnmarshalBinary(data []byte) error {
+	return l.unmarshal(data, marshalVersion)
+}
+
+// unmarshal decodes bytes written in version of the serialization format to EncodedConvLayer.
+func (l *EncodedConvLayer) unmarshal(data []byte, version byte) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data}
+	l.Im2ColX = int(d.uint64())
+	l.Im2ColY = int(d.uint64())
+	l.Stride = int(d.uint64())
+	l.mask = d.plaintext()
+
+	kernelCount := d.uint64()
+	if d.err == nil && kernelCount > uint64(len(d.data)) {
+		return fmt.Errorf("%w: invalid kernel count", ErrInvalidEncoding)
+	}
+	l.Kernel = make([]*rlwe.Plaintext, 0, kernelCount)
+	l.Bias = make([]*rlwe.Plaintext, 0, kernelCount)
+	for i := uint64(0); i < kernelCount && d.err == nil; i++ {
+		l.Kernel = append(l.Kernel, d.plaintext())
+		l.Bias = append(l.Bias, d.plaintext())
+	}
+
+	return d.close()
+}
+
+// MarshalBinary encodes EncodedLinearLayer to bytes.
+func (l EncodedLinearLayer) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	if err := writeLinearTransform(buf, l.Weights); err != nil {
+		return nil, err
+	}
+	if err := writePlaintext(buf, l.Bias); err != nil {
+		return nil, err
+	}
+	writeUint64(buf, uint64(l.InputSize))
+	writeUint64(buf, uint64(l.Copies))
+	writeUint64(buf, uint64(l.OutputSize))
+	if l.OutputSize > 0 {
+		if err := writePlaintext(buf, l.Mask); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to EncodedLinearLayer.
+func (l *EncodedLinearLayer) UnmarshalBinary(data []byte) error {
+	return l.unmarshal(data, marshalVersion)
+}
+
+// unmarshal decodes bytes written in version of the serialization format to EncodedLinearLayer.
+func (l *EncodedLinearLayer) unmarshal(data []byte, version byte) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data}
+	l.Weights = d.linearTransform()
+	l.Bias = d.plaintext()
+	l.InputSize = int(d.uint64())
+	l.Copies = int(d.uint64())
+	l.OutputSize = int(d.uint64())
+	if l.OutputSize > 0 {
+		l.Mask = d.plaintext()
+	}
+	return d.close()
+}
+
+// MarshalBinary encodes EncodedAvgPoolLayer to bytes.
+func (l EncodedAvgPoolLayer) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeLinearTransform(buf, l.Weights); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to EncodedAvgPoolLayer.
+func (l *EncodedAvgPoolLayer) UnmarshalBinary(data []byte) error {
+	return l.unmarshal(data, marshalVersion)
+}
+
+// unmarshal decodes bytes written in version of the serialization format to EncodedAvgPoolLayer.
+func (l *EncodedAvgPoolLayer) unmarshal(data []byte, version byte) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data}
+	l.Weights = d.linearTransform()
+	return d.close()
+}
+
+// MarshalBinary encodes EncodedTiledLinearLayer to bytes.
+func (l EncodedTiledLinearLayer) MarshalBinary() ([]byte, error) {
+	if len(l.Weights) == 0 || len(l.Weights[0]) == 0 || len(l.Bias) != len(l.Weights) {
+		return nil, fmt.Errorf("%w: empty tiled linear layer", ErrShapeMismatch)
+	}
+
+	buf := new(bytes.Buffer)
+	writeUint64(buf, uint64(len(l.Weights)))
+	writeUint64(buf, uint64(len(l.Weights[0])))
+	for i, row := range l.Weights {
+		if len(row) != len(l.Weights[0]) {
+			return nil, fmt.Errorf("%w: tiled linear layer has rows of %d and %d tiles", ErrShapeMismatch, len(l.Weights[0]), len(row))
+		}
+		for _, lt := range row {
+			if err := writeLinearTransform(buf, lt); err != nil {
+				return nil, err
+			}
+		}
+		if err := writePlaintext(buf, l.Bias[i]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to EncodedTiledLinearLayer.
+func (l *EncodedTiledLinearLayer) UnmarshalBinary(data []byte) error {
+	return l.unmarshal(data, marshalVersion)
+}
+
+// unmarshal decodes bytes written in version of the serialization format to EncodedTiledLinearLayer.
+func (l *EncodedTiledLinearLayer) unmarshal(data []byte, version byte) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data}
+	outTiles, inTiles := d.uint64(), d.uint64()
+	// Each tile takes at least one byte. Compare without multiplying, which can overflow.
+	if d.err == nil && (outTiles == 0 || inTiles == 0 || outTiles > uint64(len(d.data)) || inTiles > uint64(len(d.data))/outTiles) {
+		return fmt.Errorf("%w: invalid tile count", ErrInvalidEncoding)
+	}
+
+	l.Weights = make([][]ckks.LinearTransform, 0, outTiles)
+	l.Bias = make([]*rlwe.Plaintext, 0, outTiles)
+	for i := uint64(0); i < outTiles && d.err == nil; i++ {
+		row := make([]ckks.LinearTransform, 0, inTiles)
+		for j := uint64(0); j < inTiles && d.err == nil; j++ {
+			row = append(row, d.linearTransform())
+		}
+		l.Weights = append(l.Weights, row)
+		l.Bias = append(l.Bias, d.plaintext())
+	}
+
+	return d.close()
+}
+
+// MarshalBinary encodes PolyActivation to bytes.
+func (l PolyActivation) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	writeUint64(buf, uint64(len(l.Coeffs)))
+	for _, c := range l.Coeffs {
+		writeUint64(buf, math.Float64bits(c))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytes to PolyActivation.
+func (l *PolyActivation) UnmarshalBinary(data []byte) error {
+	return l.unmarshal(data, marshalVersion)
+}
+
+// unmarshal decodes bytes written in version of the serialization format to PolyActivation.
+func (l *PolyActivation) unmarshal(data []byte, version byte) error {
+	if err := checkVersion(version); err != nil {
+		return err
+	}
+
+	d := &decoder{data: data}
+	coeffCount := d.uint64()
+	if d.err == nil && coeffCount > uint64(len(d.data))/8 {
+		return fmt.Errorf("%w: invalid coefficient count", ErrInvalidEncoding)
+	}
+	l.Coeffs = make([]float64, 0, coeffCount)
+	for i := uint64(0); i < coeffCount && d.err == nil; i++ {
+		l.Coeffs = append(l.Coeffs, math.Float64frombits(d.uint64()))
+	}
+	if err := d.close(); err != nil {
+		return err
+	}
+	if err := l.check(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	return nil
+}
+
+// checkVersion returns an error if version of the serialization format is not supported.
+func checkVersion(version byte) error {
+	if version != marshalVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, version)
+	}
+	return nil
+}
+
+// writeUint64 writes v to buf in little endian.
+func writeUint64(buf *bytes.Buffer, v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	buf.Write(b[:])
+}
+
+// writeBytes writes length-prefixed b to buf.
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUint64(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+// writePoly writes length-prefixed polynomial to buf.
+// nil polynomial is written as empty bytes.
+func writePoly(buf *bytes.Buffer, p *ring.Poly) error {
+	if p == nil {
+		writeBytes(buf, nil)
+		return nil
+	}
+
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	writeBytes(buf, b)
+	return nil
+}
+
+// writePlaintext writes pt to buf.
+func writePlaintext(buf *bytes.Buffer, pt *rlwe.Plaintext) error {
+	metaBytes, err := pt.MetaData.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	writeBytes(buf, metaBytes)
+	return writePoly(buf, pt.Value)
+}
+
+// writeLinearTransform writes lt to buf.
+// Diagonals are written in increasing order, so that the output is deterministic.
+func writeLinearTransform(buf *bytes.Buffer, lt ckks.LinearTransform) error {
+	writeUint64(buf, uint64(lt.LogSlots))
+	writeUint64(buf, uint64(lt.N1))
+	writeUint64(buf, uint64(lt.Level))
+
+	scaleBytes := make([]byte, lt.Scale.MarshalBinarySize())
+	if err := lt.Scale.Encode(scaleBytes); err != nil {
+		return err
+	}
+	writeBytes(buf, scaleBytes)
+
+	idx := make([]int, 0, len(lt.Vec))
+	for i := range lt.Vec {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+
+	writeUint64(buf, uint64(len(idx)))
+	for _, i := range idx {
+		writeUint64(buf, uint64(i))
+		if err := writePoly(buf, lt.Vec[i].Q); err != nil {
+			return err
+		}
+		if err := writePoly(buf, lt.Vec[i].P); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decoder reads values written by write* functions.
+// After the first error, every read returns zero value,
+// and the error is stored in err.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+// next returns next n bytes.
+func (d *decoder) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.data)) < n {
+		d.err = fmt.Errorf("%w: unexpected end of data", ErrInvalidEncoding)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+// close returns the error of d, or an error if there is unread data.
+func (d *decoder) close() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%w: trailing data", ErrInvalidEncoding)
+	}
+	return d.err
+}
+
+// byte reads a single byte.
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// uint64 reads uint64 written by writeUint64.
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// bytes reads bytes written by writeBytes.
+func (d *decoder) bytes() []byte {
+	return d.next(d.uint64())
+}
+
+// poly reads polynomial written by writePoly.
+func (d *decoder) poly() *ring.Poly {
+	b := d.bytes()
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < 5 {
+		d.err = fmt.Errorf("%w: invalid polynomial", ErrInvalidEncoding)
+		return nil
+	}
+
+	p := new(ring.Poly)
+	if err := p.UnmarshalBinary(b); err != nil {
+		d.err = fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+		return nil
+	}
+	return p
+}
+
+// plaintext reads plaintext written by writePlaintext.
+func (d *decoder) plaintext() *rlwe.Plaintext {
+	metaBytes := d.bytes()
+	p := d.poly()
+	if d.err != nil {
+		return nil
+	}
+	if p == nil {
+		d.err = fmt.Errorf("%w: empty plaintext", ErrInvalidEncoding)
+		return nil
+	}
+
+	pt := &rlwe.Plaintext{Value: p}
+	if err := pt.MetaData.UnmarshalBinary(metaBytes); err != nil {
+		d.err = fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+		return nil
+	}
+	return pt
+}
+
+// linearTransform reads linear transform written by writeLinearTransform.
+func (d *decoder) linearTransform() ckks.LinearTransform {
+	lt := ckks.LinearTransform{
+		LogSlots: int(d.uint64()),
+		N1:       int(d.uint64()),
+		Level:    int(d.uint64()),
+	}
+
+	scaleBytes := d.bytes()
+	if d.err == nil {
+		if err := lt.Scale.Decode(scaleBytes); err != nil {
+			d.err = fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+		}
+	}
+
+	diagCount := d.uint64()
+	if d.err == nil && diagCount > uint64(len(d.data)) {
+		d.err = fmt.Errorf("%w: invalid diagonal count", ErrInvalidEncoding)
+	}
+	lt.Vec = make(map[int]ringqp.Poly)
+	for i := uint64(0); i < diagCount && d.err == nil; i++ {
+		idx := int(d.uint64())
+		lt.Vec[idx] = ringqp.Poly{Q: d.poly(), P: d.poly()}
+	}
+
+	return lt
+}
@@ -0,0 +1,183 @@
+package henn
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+)
+
+// SecurityLevel is the bit security of the parameters.
+type SecurityLevel int
+
+// Supported security levels.
+const (
+	Security128 SecurityLevel = 128
+	Security192 SecurityLevel = 192
+	Security256 SecurityLevel = 256
+)
+
+// maxLogQP is the maximum bit size of QP for each security level and LogN.
+// Taken from HomomorphicEncryption.org security standard, for ternary secrets.
+var maxLogQP = map[SecurityLevel]map[int]int{
+	Security128: {10: 27, 11: 54, 12: 109, 13: 218, 14: 438, 15: 881},
+	Security192: {10: 19, 11: 37, 12: 75, 13: 152, 14: 305, 15: 611},
+	Security256: {10: 14, 11: 29, 12: 58, 13: 118, 14: 237, 15: 476},
+}
+
+const (
+	// minLogN and maxLogN are the range of LogN considered in SelectParameters.
+	minLogN = 10
+	maxLogN = 15
+
+	// precisionMargin is the number of bits of the scale consumed by the noise.
+	precisionMargin = 10
+	// integerBits is the number of bits reserved for the integer part of the message
+	// in the first modulus.
+	integerBits = 11
+)
+
+// SelectParameters returns the ParametersLiteral suitable for layers,
+// with input of inputShape.
+// inputShape should be the image size (C, X, Y) if layers start with ConvLayer,
+// where (X, Y) is also accepted for a single channel,
+// the feature map size (C, X, Y) if layers start with FeatureConvLayer,
+// or the input size (M) if layers start with LinearLayer.
+//
+// precision is the number of fractional bits needed after decryption,
+// which determines the default scale.
+// The moduli chain has enough primes for RequiredDepth of layers,
+// and LogSlots is large enough for every layer.
+// Then, the smallest LogN that satisfies security level is chosen.
+func SelectParameters(layers []Layer, inputShape []int, precision int, security SecurityLevel) (ckks.ParametersLiteral, error) {
+	bounds, ok := maxLogQP[security]
+	if !ok {
+		return ckks.ParametersLiteral{}, fmt.Errorf("%w: unsupported security level %d", ErrUnsupportedParameters, security)
+	}
+
+	logScale := precision + precisionMargin
+	if precision <= 0 || logScale+integerBits > 60 {
+		return ckks.ParametersLiteral{}, fmt.Errorf("%w: unsupported precision %d", ErrUnsupportedParameters, precision)
+	}
+
+	if len(layers) == 0 {
+		return ckks.ParametersLiteral{}, fmt.Errorf("%w: empty layers", ErrShapeMismatch)
+	}
+	if err := checkInputShape(layers[0], inputShape); err != nil {
+		return ckks.ParametersLiteral{}, err
+	}
+
+	slots := 1
+	depth := 0
+	for _, l := range layers {
+		if s := layerSlots(l); s > slots {
+			slots = s
+		}
+		depth += layerDepth(l)
+	}
+	logSlots := bits.Len(uint(slots - 1))
+
+	logQ := make([]int, depth+1)
+	logQ[0] = logScale + integerBits
+	for i := 1; i < len(logQ); i++ {
+		logQ[i] = logScale
+	}
+	logP := []int{logScale + integerBits}
+
+	logQP := 0
+	for _, q := range append(logQ, logP...) {
+		logQP += q
+	}
+
+	for logN := minLogN; logN <= maxLogN; logN++ {
+		if logN <= logSlots || bounds[logN] < logQP {
+			continue
+		}
+
+		paramsLiteral := ckks.ParametersLiteral{
+			LogN:         logN,
+			LogQ:         logQ,
+			LogP:         logP,
+			LogSlots:     logSlots,
+			DefaultScale: float64(uint64(1) << logScale),
+		}
+
+		// Check if enough primes exist.
+		if _, err := ckks.NewParametersFromLiteral(paramsLiteral); err != nil {
+			return ckks.ParametersLiteral{}, fmt.Errorf("%w: %v", ErrUnsupportedParameters, err)
+		}
+
+		return paramsLiteral, nil
+	}
+
+	return ckks.ParametersLiteral{}, fmt.Errorf("%w: LogQP %d with %d slots exceeds %d-bit security bound", ErrUnsupportedParameters, logQP, slots, security)
+}
+
+// checkInputShape checks if inputShape matches the first layer.
+func checkInputShape(l Layer, inputShape []int) error {
+	switch l := l.(type) {
+	case ConvLayer:
+		if l.check(math.MaxInt32) != nil {
+			return fmt.Errorf("%w: invalid convolution", ErrShapeMismatch)
+		}
+		c, _, _ := l.kernelShape()
+		if len(inputShape) == 2 && c == 1 {
+			inputShape = []int{1, inputShape[0], inputShape[1]}
+		}
+		if len(inputShape) != 3 || inputShape[0] != c || inputShape[1] != l.InputX || inputShape[2] != l.InputY {
+			return fmt.Errorf("%w: input shape %v does not match convolution input %d*%d*%d", ErrShapeMismatch, inputShape, c, l.InputX, l.InputY)
+		}
+	case FeatureConvLayer:
+		if l.check(math.MaxInt32) != nil {
+			return fmt.Errorf("%w: invalid convolution", ErrShapeMismatch)
+		}
+		c, _, _ := ConvLayer(l).kernelShape()
+		if len(inputShape) != 3 || inputShape[0] != c || inputShape[1] != l.InputX || inputShape[2] != l.InputY {
+			return fmt.Errorf("%w: input shape %v does not match convolution input %d*%d*%d", ErrShapeMismatch, inputShape, c, l.InputX, l.InputY)
+		}
+	case LinearLayer:
+		if len(l.Weights) == 0 || len(inputShape) != 1 || inputShape[0] != len(l.Weights[0]) {
+			return fmt.Errorf("%w: input shape %v does not match linear input", ErrShapeMismatch, inputShape)
+		}
+	default:
+		return fmt.Errorf("%w: first layer should be ConvLayer, FeatureConvLayer or LinearLayer", ErrUnsupportedLayer)
+	}
+	return nil
+}
+
+// layerSlots returns the number of slots needed to evaluate l.
+func layerSlots(l Layer) int {
+	switch l := l.(type) {
+	case ConvLayer:
+		if l.check(math.MaxInt32) != nil {
+			return 0
+		}
+		kSize, repeat := l.im2ColSize()
+		if len(l.Kernel) > kSize {
+			return len(l.Kernel) * repeat
+		}
+		return kSize * repeat
+	case AvgPoolLayer:
+		return l.Channels * l.InputX * l.InputY
+	case FeatureConvLayer:
+		if l.check(math.MaxInt32) != nil {
+			return 0
+		}
+		c, _, _ := ConvLayer(l).kernelShape()
+		outC, outX, outY := l.OutputShape()
+		if c*l.InputX*l.InputY > outC*outX*outY {
+			return c * l.InputX * l.InputY
+		}
+		return outC * outX * outY
+	case LinearLayer:
+		if len(l.Weights) == 0 {
+			return 0
+		}
+		if len(l.Weights) > len(l.Weights[0]) {
+			return len(l.Weights)
+		}
+		return len(l.Weights[0])
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package henn
+
+import (
+	"fmt"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// LayerPlan represents the levels of the ciphertext entering and leaving a layer.
+type LayerPlan struct {
+	Index int
+	Layer string
+
+	LevelIn  int
+	LevelOut int
+	// Depth is the number of levels consumed by this layer.
+	Depth int
+}
+
+// RequiredDepth returns the number of levels consumed by this network,
+// assuming that every modulus is close to the default scale.
+func (nn *HENeuralNet) RequiredDepth() int {
+	depth := 0
+	for _, l := range nn.Layers {
+		depth += layerDepth(l)
+	}
+	return depth
+}
+
+// layerDepth returns the number of levels consumed by l,
+// assuming that every modulus is close to the default scale.
+// l can be either Layer or EncodedLayer.
+func layerDepth(l interface{}) int {
+	switch l := l.(type) {
+	case ConvLayer, EncodedConvLayer:
+		// Multiplication by kernel and mask
+		return 2
+	case EncodedLinearLayer:
+		if l.Mask != nil {
+			// Multiplication by weights and mask
+			return 2
+		}
+		return 1
+	case LinearLayer, EncodedTiledLinearLayer, FeatureConvLayer, AvgPoolLayer, EncodedAvgPoolLayer:
+		return 1
+	case ActivationLayer:
+		return l.Depth
+	case PolyActivation:
+		return l.Depth()
+	}
+	return 0
+}
+
+// layerName returns the name of l used in reports.
+// l can be either Layer or EncodedLayer.
+func layerName(l interface{}) string {
+	switch l := l.(type) {
+	case ConvLayer, EncodedConvLayer:
+		return "conv"
+	case LinearLayer, EncodedLinearLayer, EncodedTiledLinearLayer:
+		return "linear"
+	case FeatureConvLayer:
+		return "featureconv"
+	case AvgPoolLayer, EncodedAvgPoolLayer:
+		return "avgpool"
+	case ActivationLayer:
+		if l.Name != "" {
+			return fmt.Sprintf("activation(%s)", l.Name)
+		}
+		return "activation"
+	case PolyActivation:
+		if l.isSquare() {
+			return "square"
+		}
+		return fmt.Sprintf("poly(%d)", len(l.Coeffs)-1)
+	}
+	return fmt.Sprintf("%T", l)
+}
+
+// Plan walks through layers, and reports the levels entering and leaving each layer,
+// starting from the maximum level of the parameters.
+// It returns ErrInsufficientLevels if the moduli chain runs out.
+//
+// Levels consumed by ActivationLayer are taken from its Depth field.
+func (nn *HENeuralNet) Plan() ([]LayerPlan, error) {
+	return nn.plan(nn.Parameters.MaxLevel(), nn.Parameters.DefaultScale())
+}
+
+// plan simulates the levels and scales of the ciphertext through layers,
+// starting from level and scale.
+func (nn *HENeuralNet) plan(level int, scale rlwe.Scale) ([]LayerPlan, error) {
+	plans := make([]LayerPlan, 0, len(nn.Layers))
+
+	for i, l := range nn.Layers {
+		p := LayerPlan{Index: i, Layer: layerName(l), LevelIn: level}
+
+		var err error
+		switch l := l.(type) {
+		case EncodedConvLayer:
+			scale = scale.Mul(l.Kernel[0].Scale).Mul(l.mask.Scale)
+			level, scale, err = nn.planRescale(level, scale)
+		case EncodedLinearLayer:
+			scale = scale.Mul(l.Weights.Scale)
+			if l.Mask != nil {
+				scale = scale.Mul(l.Mask.Scale)
+			}
+			level, scale, err = nn.planRescale(level, scale)
+		case EncodedTiledLinearLayer:
+			if len(l.Weights) == 0 || len(l.Weights[0]) == 0 {
+				err = fmt.Errorf("%w: empty tiled linear layer", ErrShapeMismatch)
+				break
+			}
+			// Every block has the same scale.
+			scale = scale.Mul(l.Weights[0][0].Scale)
+			level, scale, err = nn.planRescale(level, scale)
+		case EncodedAvgPoolLayer:
+			scale = scale.Mul(l.Weights.Scale)
+			level, scale, err = nn.planRescale(level, scale)
+		case ActivationLayer:
+			if level -= l.Depth; level < 0 {
+				err = ErrInsufficientLevels
+			}
+		case PolyActivation:
+			if level -= l.Depth(); level < 0 {
+				err = ErrInsufficientLevels
+			}
+		default:
+			err = fmt.Errorf("%w: %T", ErrUnsupportedLayer, l)
+		}
+		if err != nil {
+			return plans, fmt.Errorf("layer %d: %w", i, err)
+		}
+
+		p.LevelOut = level
+		p.Depth = p.LevelIn - p.LevelOut
+		plans = append(plans, p)
+	}
+
+	return plans, nil
+}
+
+// planRescale simulates Rescale of the ciphertext with level and scale,
+// returning level and scale after Rescale.
+// Follows the logic of Rescale in Lattigo.
+func (nn *HENeuralNet) planRescale(level int, scale rlwe.Scale) (int, rlwe.Scale, error) {
+	if level == 0 {
+		return 0, scale, ErrInsufficientLevels
+	}
+
+	minScale := nn.Parameters.DefaultScale().Div(rlwe.NewScale(2))
+	for level >= 0 {
+		newScale := scale.Div(rlwe.NewScale(nn.Parameters.Q()[level]))
+		if newScale.Cmp(minScale) == -1 {
+			break
+		}
+		scale = newScale
+		level--
+	}
+	if level < 0 {
+		return 0, scale, ErrInsufficientLevels
+	}
+
+	return level, scale, nil
+}
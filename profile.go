@@ -0,0 +1,108 @@
+package henn
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// LayerProfile represents the precision of the ciphertext after a layer,
+// compared to the output of PlainNeuralNet.
+type LayerProfile struct {
+	Index int
+	Layer string
+
+	// Level and LogScale are the level and log2 of the scale of the output ciphertext.
+	Level    int
+	LogScale float64
+
+	// MaxError and MeanError are the maximum and mean absolute error over all slots.
+	MaxError  float64
+	MeanError float64
+	// MinPrecision and MeanPrecision are the precision in bits,
+	// computed from MaxError and MeanError as ckks.GetPrecisionStats.
+	MinPrecision  float64
+	MeanPrecision float64
+}
+
+// Profile executes Infer on ctIn, decrypting the ciphertext with sk after every layer.
+// Each output is compared with the output of reference on msgIn,
+// which should be the message encrypted in ctIn.
+// reference should have the same layers as this model.
+// If this model is batched, reference should have the slots of one block,
+// and only the first input of ctIn is compared.
+//
+// Since it requires the secret key, this should only be used for debugging,
+// for example to choose DefaultScale and activations of a new model.
+func (nn *HENeuralNet) Profile(ctIn *rlwe.Ciphertext, sk *rlwe.SecretKey, reference *PlainNeuralNet, msgIn []float64) ([]LayerProfile, error) {
+	if nn.Evaluator == nil {
+		return nil, ErrNotInitialized
+	}
+	if ctIn == nil || ctIn.Degree() != 1 || ctIn.Value[0].N() != nn.Parameters.N() || ctIn.Level() > nn.Parameters.MaxLevel() {
+		return nil, fmt.Errorf("%w: malformed ciphertext", ErrShapeMismatch)
+	}
+	if sk == nil || sk.Value.Q == nil || sk.Value.Q.N() != nn.Parameters.N() {
+		return nil, fmt.Errorf("%w: malformed secret key", ErrInvalidKeys)
+	}
+	if reference == nil || reference.Slots != nn.blockSize() || len(reference.Layers) != len(nn.Layers) {
+		return nil, fmt.Errorf("%w: reference does not match the model", ErrShapeMismatch)
+	}
+
+	if _, err := nn.plan(ctIn.Level(), ctIn.Scale); err != nil {
+		return nil, err
+	}
+
+	msgs, err := reference.InferLayers(msgIn)
+	if err != nil {
+		return nil, err
+	}
+
+	leased, release := nn.lease(nn.evaluationContext())
+	defer release()
+
+	decryptor := ckks.NewDecryptor(nn.Parameters, sk)
+	profiles := make([]LayerProfile, 0, len(nn.Layers))
+	hook := func(i int, ct []*rlwe.Ciphertext) error {
+		// Reference has the values of the first input in ciphertext j at j * Slots.
+		want := msgs[i+1]
+		if len(want) != len(ct)*reference.Slots {
+			return fmt.Errorf("%w: reference has %d values, but output has %d ciphertexts", ErrShapeMismatch, len(want), len(ct))
+		}
+		got := make([]float64, 0, len(want))
+		for _, c := range ct {
+			decoded := leased.Encoder.Decode(decryptor.DecryptNew(c), nn.Parameters.LogSlots())
+			for j := 0; j < reference.Slots; j++ {
+				got = append(got, real(decoded[j]))
+			}
+		}
+
+		p := LayerProfile{
+			Index:    i,
+			Layer:    layerName(nn.Layers[i]),
+			Level:    ct[0].Level(),
+			LogScale: math.Log2(ct[0].Scale.Float64()),
+		}
+
+		for j := range want {
+			e := math.Abs(want[j] - got[j])
+			p.MaxError = math.Max(p.MaxError, e)
+			p.MeanError += e
+		}
+		p.MeanError /= float64(len(want))
+
+		// Same as ckks.GetPrecisionStats, which needs the power of two number of values.
+		p.MinPrecision = math.Log2(1 / p.MaxError)
+		p.MeanPrecision = math.Log2(1 / p.MeanError)
+
+		profiles = append(profiles, p)
+		return nil
+	}
+
+	if _, err := leased.infer([]*rlwe.Ciphertext{ctIn}, hook); err != nil {
+		return profiles, err
+	}
+
+	return profiles, nil
+}
@@ -0,0 +1,248 @@
+package henn
+
+import (
+	"fmt"
+)
+
+// PlainNeuralNet evaluates layers on cleartext,
+// with exactly the same packing as HENeuralNet.
+// It is used as a reference to check the output of HENeuralNet:
+// the output of each layer matches the decrypted output of HENeuralNet,
+// up to the noise of CKKS.
+type PlainNeuralNet struct {
+	// Slots is the number of slots of the ciphertext to simulate.
+	Slots int
+
+	Layers []Layer
+}
+
+// NewPlainNeuralNet creates a new PlainNeuralNet with slots, from layers.
+// Usually, slots should be the Slots of the parameters of HENeuralNet.
+func NewPlainNeuralNet(slots int, layers ...Layer) (*PlainNeuralNet, error) {
+	if slots <= 0 {
+		return nil, fmt.Errorf("%w: invalid number of slots %d", ErrShapeMismatch, slots)
+	}
+
+	for i, l := range layers {
+		var err error
+		switch l := l.(type) {
+		case ConvLayer:
+			err = l.check(slots)
+		case LinearLayer:
+			err = l.checkWeights()
+		case AvgPoolLayer:
+			err = l.check(slots)
+		case FeatureConvLayer:
+			err = l.check(slots)
+		case ActivationLayer:
+			if l.PlaintextFn == nil {
+				err = fmt.Errorf("%w: nil PlaintextFn", ErrUnsupportedLayer)
+			}
+		case PolyActivation:
+			err = l.check()
+		default:
+			err = fmt.Errorf("%w: %T", ErrUnsupportedLayer, l)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	return &PlainNeuralNet{
+		Slots:  slots,
+		Layers: layers,
+	}, nil
+}
+
+// Infer evaluates the model on msgIn, and returns the output.
+// msgIn is the message that would be encrypted as the input of HENeuralNet,
+// for example, Im2Col encoded image if model starts with ConvLayer.
+// Output has length Slots, same as the decrypted output of HENeuralNet.
+// If the output does not fit in one ciphertext, output has the concatenation of
+// Slots values of each ciphertext, as DecryptFloatsVector does.
+func (nn *PlainNeuralNet) Infer(msgIn []float64) ([]float64, error) {
+	msgs, err := nn.InferLayers(msgIn)
+	if err != nil {
+		return nil, err
+	}
+	return msgs[len(msgs)-1], nil
+}
+
+// InferLayers evaluates the model on msgIn,
+// and returns the input followed by the output of every layer.
+// That is, InferLayers(msgIn)[i+1] is the output of Layers[i].
+func (nn *PlainNeuralNet) InferLayers(msgIn []float64) ([][]float64, error) {
+	// msgIn is padded to the multiple of Slots, as EncryptFloatsVector does.
+	msg := make([]float64, nn.tiles(len(msgIn))*nn.Slots)
+	copy(msg, msgIn)
+
+	msgs := make([][]float64, 0, len(nn.Layers)+1)
+	msgs = append(msgs, msg)
+	for i, l := range nn.Layers {
+		var err error
+		switch l := l.(type) {
+		case ConvLayer:
+			msg, err = nn.conv(l, msg)
+		case LinearLayer:
+			msg, err = nn.linear(l, msg)
+		case AvgPoolLayer:
+			msg, err = nn.avgPool(l, msg)
+		case FeatureConvLayer:
+			msg, err = nn.featureConv(l, msg)
+		case ActivationLayer:
+			msg, err = nn.activate(l, msg)
+		case PolyActivation:
+			msg, err = nn.activate(ActivationLayer{PlaintextFn: l.evaluate}, msg)
+		default:
+			err = fmt.Errorf("%w: %T", ErrUnsupportedLayer, l)
+		}
+		if err != nil {
+			return msgs, fmt.Errorf("layer %d: %w", i, err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// tiles returns the number of ciphertexts needed for n values.
+func (nn *PlainNeuralNet) tiles(n int) int {
+	if n <= nn.Slots {
+		return 1
+	}
+	return (n + nn.Slots - 1) / nn.Slots
+}
+
+// checkSingle checks if msg fits in one ciphertext,
+// which is needed for layers other than LinearLayer and activations.
+func (nn *PlainNeuralNet) checkSingle(msg []float64) error {
+	if len(msg) != nn.Slots {
+		return fmt.Errorf("%w: input has %d ciphertexts, but layer takes one", ErrShapeMismatch, nn.tiles(len(msg)))
+	}
+	return nil
+}
+
+// conv executes ConvLayer.
+// Output of i-th kernel is placed at i * Im2ColY.
+func (nn *PlainNeuralNet) conv(cl ConvLayer, msg []float64) ([]float64, error) {
+	if err := cl.check(nn.Slots); err != nil {
+		return nil, err
+	}
+	if err := nn.checkSingle(msg); err != nil {
+		return nil, err
+	}
+
+	_, repeat := cl.im2ColSize()
+	msgOut := make([]float64, nn.Slots)
+	for i, k := range cl.Kernel {
+		flattenedKernel := flattenKernel(k)
+		for n := 0; n < repeat; n++ {
+			v := cl.Bias[i]
+			for j, w := range flattenedKernel {
+				v += w * msg[j*repeat+n]
+			}
+			msgOut[i*repeat+n] = v
+		}
+	}
+
+	return msgOut, nil
+}
+
+// linear executes LinearLayer.
+// Input and output can span multiple ciphertexts, as EncodedTiledLinearLayer.
+func (nn *PlainNeuralNet) linear(ll LinearLayer, msg []float64) ([]float64, error) {
+	if err := ll.checkWeights(); err != nil {
+		return nil, err
+	}
+	if nn.tiles(len(ll.Weights[0])) != nn.tiles(len(msg)) {
+		return nil, fmt.Errorf("%w: linear layer takes %d ciphertexts, got %d", ErrShapeMismatch, nn.tiles(len(ll.Weights[0])), nn.tiles(len(msg)))
+	}
+
+	msgOut := make([]float64, nn.tiles(len(ll.Weights))*nn.Slots)
+	for i, row := range ll.Weights {
+		v := ll.Bias[i]
+		for j, w := range row {
+			v += w * msg[j]
+		}
+		msgOut[i] = v
+	}
+
+	return msgOut, nil
+}
+
+// featureConv executes FeatureConvLayer.
+func (nn *PlainNeuralNet) featureConv(fl FeatureConvLayer, msg []float64) ([]float64, error) {
+	if err := fl.check(nn.Slots); err != nil {
+		return nil, err
+	}
+	if err := nn.checkSingle(msg); err != nil {
+		return nil, err
+	}
+
+	_, outX, outY := fl.OutputShape()
+	inSize, outSize := fl.InputX*fl.InputY, outX*outY
+	msgOut := make([]float64, nn.Slots)
+	for o, k := range fl.Kernel {
+		for i := 0; i < outX; i++ {
+			for j := 0; j < outY; j++ {
+				v := fl.Bias[o]
+				for c := range k {
+					for di := 0; di < fl.KernelX; di++ {
+						for dj := 0; dj < fl.KernelY; dj++ {
+							if in, ok := fl.inputIndex(i*fl.StrideX+di, j*fl.StrideY+dj); ok {
+								v += k[c][di][dj] * msg[c*inSize+in]
+							}
+						}
+					}
+				}
+				msgOut[o*outSize+i*outY+j] = v
+			}
+		}
+	}
+
+	return msgOut, nil
+}
+
+// avgPool executes AvgPoolLayer.
+func (nn *PlainNeuralNet) avgPool(pl AvgPoolLayer, msg []float64) ([]float64, error) {
+	if err := pl.check(nn.Slots); err != nil {
+		return nil, err
+	}
+	if err := nn.checkSingle(msg); err != nil {
+		return nil, err
+	}
+
+	_, outX, outY := pl.OutputShape()
+	inSize, outSize := pl.InputX*pl.InputY, outX*outY
+	msgOut := make([]float64, nn.Slots)
+	for c := 0; c < pl.Channels; c++ {
+		for i := 0; i < outX; i++ {
+			for j := 0; j < outY; j++ {
+				v := 0.0
+				for di := 0; di < pl.Window; di++ {
+					for dj := 0; dj < pl.Window; dj++ {
+						v += msg[c*inSize+(i*pl.Stride+di)*pl.InputY+j*pl.Stride+dj]
+					}
+				}
+				msgOut[c*outSize+i*outY+j] = v / float64(pl.Window*pl.Window)
+			}
+		}
+	}
+
+	return msgOut, nil
+}
+
+// activate executes ActivationLayer.
+// PlaintextFn is applied to every slot, as ActivationFn does.
+func (nn *PlainNeuralNet) activate(l ActivationLayer, msg []float64) ([]float64, error) {
+	if l.PlaintextFn == nil {
+		return nil, fmt.Errorf("%w: nil PlaintextFn", ErrUnsupportedLayer)
+	}
+
+	msgOut := make([]float64, len(msg))
+	for i, v := range msg {
+		msgOut[i] = l.PlaintextFn(v)
+	}
+
+	return msgOut, nil
+}
@@ -0,0 +1,294 @@
+package henn
+
+import (
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// RotationCost is the cost of rotations needed to infer from HENeuralNet.
+type RotationCost struct {
+	// Keys is the number of rotation keys.
+	Keys int
+	// KeyBytes is the total size of rotation keys in bytes, as reported by KeyReport.
+	KeyBytes int
+	// KeySwitches is the number of key switches done by rotations in one Infer.
+	KeySwitches int
+}
+
+// RotationTradeoff reports the cost of rotations with every rotation key,
+// and with only power-of-two rotation keys, as PowerOfTwoRotations does.
+// Usually, power-of-two keys are much smaller, but need more key switches.
+func (nn *HENeuralNet) RotationTradeoff() (full, powerOfTwo RotationCost) {
+	fullKeys := NewKeyReport(nn.Parameters, nn.rotations(false))
+	full.Keys = fullKeys.GaloisKeys
+	full.KeyBytes = fullKeys.RotationKeyBytes
+	for _, rot := range nn.rotationSchedule(false) {
+		if rot%nn.Parameters.Slots() != 0 {
+			full.KeySwitches++
+		}
+	}
+
+	powerOfTwoKeys := NewKeyReport(nn.Parameters, nn.rotations(true))
+	powerOfTwo.Keys = powerOfTwoKeys.GaloisKeys
+	powerOfTwo.KeyBytes = powerOfTwoKeys.RotationKeyBytes
+	for _, rot := range nn.rotationSchedule(true) {
+		powerOfTwo.KeySwitches += len(composeRotation(rot, nn.Parameters.Slots()))
+	}
+
+	return full, powerOfTwo
+}
+
+// rotations returns the rotations that need keys, excluding the trivial ones.
+// If powerOfTwo is true, only rotations by ±2^k are returned.
+func (nn *HENeuralNet) rotations(powerOfTwo bool) []int {
+	slots := nn.Parameters.Slots()
+
+	rotSet := make(map[int]struct{})
+	if powerOfTwo {
+		for _, rot := range nn.rotationSchedule(true) {
+			for _, r := range composeRotation(rot, slots) {
+				rotSet[r] = struct{}{}
+			}
+		}
+	} else {
+		for _, rot := range nn.fullRotations() {
+			if rot%slots != 0 {
+				rotSet[rot] = struct{}{}
+			}
+		}
+	}
+
+	rots := make([]int, 0, len(rotSet))
+	for r := range rotSet {
+		rots = append(rots, r)
+	}
+	sort.Ints(rots)
+	return rots
+}
+
+// rotationSchedule returns the rotations done by one Infer, in order of evaluation.
+// If powerOfTwo is true, it follows the evaluation with PowerOfTwoRotations,
+// where each rotation is composed of power-of-two rotations later.
+func (nn *HENeuralNet) rotationSchedule(powerOfTwo bool) []int {
+	var rots []int
+	for _, l := range nn.Layers {
+		switch l := l.(type) {
+		case EncodedConvLayer:
+			for i := range l.Kernel {
+				rots = append(rots, innerSumRotations(l.Im2ColY, l.Im2ColX, powerOfTwo)...)
+				rots = append(rots, -i*l.Im2ColY)
+			}
+		case EncodedLinearLayer:
+			for c := 1; c < l.Copies; c <<= 1 {
+				rots = append(rots, -c*l.InputSize)
+			}
+			rots = append(rots, linearTransformRotations(l.Weights)...)
+			for s := l.InputSize / 2; l.OutputSize > 0 && s >= l.OutputSize; s >>= 1 {
+				rots = append(rots, s)
+			}
+		case EncodedTiledLinearLayer:
+			for _, row := range l.Weights {
+				for _, lt := range row {
+					rots = append(rots, linearTransformRotations(lt)...)
+				}
+			}
+		case EncodedAvgPoolLayer:
+			rots = append(rots, linearTransformRotations(l.Weights)...)
+		}
+	}
+	return rots
+}
+
+// innerSumRotations returns the rotations done by InnerSum of n blocks of size batchSize.
+// If powerOfTwo is false, it follows InnerSum in Lattigo.
+// Otherwise, it follows innerSum.
+func innerSumRotations(batchSize, n int, powerOfTwo bool) []int {
+	var rots []int
+	offset := 0
+	for i, j := 0, n; j > 0; i, j = i+1, j>>1 {
+		if j&1 == 1 {
+			if powerOfTwo {
+				rots = append(rots, offset)
+				offset += batchSize << i
+			} else if k := (n - (n & ((2 << i) - 1))) * batchSize; k != 0 {
+				rots = append(rots, k)
+			}
+		}
+		if j > 1 {
+			rots = append(rots, batchSize<<i)
+		}
+	}
+	return rots
+}
+
+// linearTransformRotations returns the rotations done by lt,
+// which are the baby steps followed by the giant steps.
+func linearTransformRotations(lt ckks.LinearTransform) []int {
+	if len(lt.Vec) == 0 {
+		return nil
+	}
+
+	babySteps, giantSteps := linearTransformSteps(lt)
+	rots := make([]int, 0, len(babySteps)+len(giantSteps))
+	rots = append(rots, babySteps...)
+	rots = append(rots, giantSteps...)
+	return rots
+}
+
+// linearTransformSteps returns the sorted baby steps and giant steps of lt.
+// If lt does not use BSGS, every diagonal is a baby step.
+func linearTransformSteps(lt ckks.LinearTransform) (babySteps, giantSteps []int) {
+	if lt.N1 == 0 {
+		for k := range lt.Vec {
+			babySteps = append(babySteps, k)
+		}
+		sort.Ints(babySteps)
+		return babySteps, []int{0}
+	}
+
+	index, _, babySteps := ckks.BsgsIndex(lt.Vec, 1<<lt.LogSlots, lt.N1)
+	for j := range index {
+		giantSteps = append(giantSteps, j)
+	}
+	sort.Ints(babySteps)
+	sort.Ints(giantSteps)
+	return babySteps, giantSteps
+}
+
+// composeRotation returns the rotations by ±2^k whose composition is the rotation by k.
+// This is the non-adjacent form of k modulo slots, which has the fewest nonzero terms.
+func composeRotation(k, slots int) []int {
+	k = ((k % slots) + slots) % slots
+
+	var rots []int
+	for p := 1; k != 0; p <<= 1 {
+		if k&1 == 1 {
+			// d is 1 or -1, so that k - d is divisible by 4.
+			d := 2 - k&3
+			k -= d
+			if r := d * p; r%slots != 0 {
+				// Rotations by slots/2 and -slots/2 are the same.
+				if r == -slots/2 {
+					r = slots / 2
+				}
+				rots = append(rots, r)
+			}
+		}
+		k >>= 1
+	}
+	return rots
+}
+
+// rotate rotates ct by k using eval, and writes the result to ctOut.
+// If PowerOfTwoRotations is set, the rotation is composed of power-of-two rotations.
+func (nn *HENeuralNet) rotate(eval ckks.Evaluator, ct *rlwe.Ciphertext, k int, ctOut *rlwe.Ciphertext) {
+	if !nn.PowerOfTwoRotations {
+		eval.Rotate(ct, k, ctOut)
+		return
+	}
+
+	rots := composeRotation(k, nn.Parameters.Slots())
+	if len(rots) == 0 {
+		if ct != ctOut {
+			ctOut.Resize(ct.Degree(), ct.Level())
+			ctOut.Copy(ct)
+		}
+		return
+	}
+
+	eval.Rotate(ct, rots[0], ctOut)
+	for _, r := range rots[1:] {
+		eval.Rotate(ctOut, r, ctOut)
+	}
+}
+
+// innerSum sums n blocks of size batchSize of ct using eval, and writes the result to ctOut,
+// as InnerSum in Lattigo.
+// If PowerOfTwoRotations is set, rotations are composed of power-of-two rotations.
+// The rotations done here are listed by innerSumRotations.
+func (nn *HENeuralNet) innerSum(eval ckks.Evaluator, ct *rlwe.Ciphertext, batchSize, n int, ctOut *rlwe.Ciphertext) {
+	if !nn.PowerOfTwoRotations {
+		eval.InnerSum(ct, batchSize, n, ctOut)
+		return
+	}
+
+	// ctPow holds the sum of the first 2^i blocks,
+	// which is added to ctSum at offset if the i-th bit of n is set.
+	ctPow := ct.CopyNew()
+	ctTemp := rlwe.NewCiphertext(nn.Parameters.Parameters, ct.Degree(), ct.Level())
+	var ctSum *rlwe.Ciphertext
+	offset := 0
+	for i, j := 0, n; j > 0; i, j = i+1, j>>1 {
+		if j&1 == 1 {
+			nn.rotate(eval, ctPow, offset, ctTemp)
+			if ctSum == nil {
+				ctSum = ctTemp.CopyNew()
+			} else {
+				eval.Add(ctSum, ctTemp, ctSum)
+			}
+			offset += batchSize << i
+		}
+		if j > 1 {
+			nn.rotate(eval, ctPow, batchSize<<i, ctTemp)
+			eval.Add(ctPow, ctTemp, ctPow)
+		}
+	}
+
+	ctOut.Resize(ctSum.Degree(), ctSum.Level())
+	ctOut.Copy(ctSum)
+}
+
+// linearTransform evaluates lt on ct using eval, and writes the result to ctOut,
+// as LinearTransform in Lattigo.
+// If PowerOfTwoRotations is set, the baby steps and giant steps of lt are evaluated
+// one by one with rotations composed of power-of-two rotations,
+// instead of hoisted rotations that need a key for every step.
+func (nn *HENeuralNet) linearTransform(eval ckks.Evaluator, ct *rlwe.Ciphertext, lt ckks.LinearTransform, ctOut *rlwe.Ciphertext) {
+	if !nn.PowerOfTwoRotations {
+		eval.LinearTransform(ct, lt, []*rlwe.Ciphertext{ctOut})
+		return
+	}
+
+	ringQ := nn.Parameters.RingQ()
+	level := ct.Level()
+	if lt.Level < level {
+		level = lt.Level
+	}
+
+	babySteps, giantSteps := linearTransformSteps(lt)
+	ctBaby := make(map[int]*rlwe.Ciphertext, len(babySteps))
+	for _, i := range babySteps {
+		ctBaby[i] = ckks.NewCiphertext(nn.Parameters, 1, level)
+		nn.rotate(eval, ct, i, ctBaby[i])
+	}
+
+	// Vec is in Montgomery form, so MulCoeffsMontgomery gives the plain product.
+	ctAcc := ckks.NewCiphertext(nn.Parameters, 1, level)
+	ctGiant := ckks.NewCiphertext(nn.Parameters, 1, level)
+	for _, j := range giantSteps {
+		ctGiant.Value[0].Zero()
+		ctGiant.Value[1].Zero()
+		for _, i := range babySteps {
+			diag, ok := lt.Vec[(j+i)&(nn.Parameters.Slots()-1)]
+			if lt.N1 == 0 {
+				diag, ok = lt.Vec[i]
+			}
+			if !ok {
+				continue
+			}
+			ringQ.MulCoeffsMontgomeryAndAddLvl(level, diag.Q, ctBaby[i].Value[0], ctGiant.Value[0])
+			ringQ.MulCoeffsMontgomeryAndAddLvl(level, diag.Q, ctBaby[i].Value[1], ctGiant.Value[1])
+		}
+
+		nn.rotate(eval, ctGiant, j, ctGiant)
+		ringQ.AddLvl(level, ctAcc.Value[0], ctGiant.Value[0], ctAcc.Value[0])
+		ringQ.AddLvl(level, ctAcc.Value[1], ctGiant.Value[1], ctAcc.Value[1])
+	}
+
+	ctOut.Resize(1, level)
+	ctOut.Copy(ctAcc)
+	ctOut.MetaData = ct.MetaData
+	ctOut.Scale = ct.Scale.Mul(lt.Scale)
+}
@@ -0,0 +1,358 @@
+package henn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/ring"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+	"github.com/tuneinsight/lattigo/v4/rlwe/ringqp"
+	"github.com/tuneinsight/lattigo/v4/utils"
+)
+
+// seededMagic is written at the start of every seeded ciphertext.
+var seededMagic = []byte("HENS")
+
+// seededVersion is the version of the seeded ciphertext format.
+const seededVersion = 1
+
+// A ciphertext or a key encrypted with the secret key is (b, a) with b = -a*s + e + m,
+// where a is uniformly random. In the seeded format, a is generated from a seed,
+// so only the seed and b are sent, which is about half the size.
+// The server expands the seed to a with the same sampler.
+//
+// Ciphertexts and keys of ClientContext are not generated from seeds,
+// so they are reseeded before encoding: a is replaced by a' generated from a seed,
+// and b by b + (a - a')*s, which is an encryption of the same message with a'.
+// Sending both (b, a) and (b', a') reveals s, so they are reseeded in place.
+//
+// The seed is derived from b + a*s, which does not change by reseeding,
+// so encoding them again gives the same a' and the same bytes.
+
+// MarshalSeededCiphertext encodes ct in the seeded format, which is about half the size of ct.MarshalBinary.
+// ct should be a fresh ciphertext decryptable by this context, such as the output of EncryptFloats or EncryptIm2Col.
+// ct is reseeded in place, so it should not have been sent in any other form before.
+// Encoding ct again gives the same bytes.
+// The server decodes it with UnmarshalSeededCiphertext.
+func (ctx *ClientContext) MarshalSeededCiphertext(ct *rlwe.Ciphertext) ([]byte, error) {
+	if ct.Degree() != 1 || !ct.IsNTT {
+		return nil, fmt.Errorf("%w: seeded ciphertext should be of degree 1 in NTT form", ErrShapeMismatch)
+	}
+	if ct.Level() > ctx.Parameters.MaxLevel() {
+		return nil, ErrParametersMismatch
+	}
+
+	ringQ := ringqp.Ring{RingQ: ctx.Parameters.RingQ()}
+	b, a, sk := ringqp.Poly{Q: ct.Value[0]}, ringqp.Poly{Q: ct.Value[1]}, ringqp.Poly{Q: ctx.SecretKey.Value.Q}
+	seed, err := derivedSeed(ringQ, ct.Level(), -1, sk, [][2]ringqp.Poly{{b, a}})
+	if err != nil {
+		return nil, err
+	}
+	if err := reseed(ringQ, ct.Level(), -1, b, a, sk, seed); err != nil {
+		return nil, err
+	}
+
+	metaBytes, err := ct.MetaData.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(seededMagic)
+	buf.WriteByte(seededVersion)
+	buf.Write(seed)
+	writeBytes(buf, metaBytes)
+	if err := writePoly(buf, ct.Value[0]); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalSeededCiphertext decodes a ciphertext encoded by ClientContext.MarshalSeededCiphertext,
+// expanding its seed with params.
+func UnmarshalSeededCiphertext(params ckks.Parameters, data []byte) (ct *rlwe.Ciphertext, err error) {
+	defer recoverError(&err, ErrInvalidEncoding)
+
+	if len(data) < len(seededMagic)+1 || !bytes.Equal(data[:len(seededMagic)], seededMagic) {
+		return nil, fmt.Errorf("%w: invalid header", ErrInvalidEncoding)
+	}
+	if v := data[len(seededMagic)]; v != seededVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidEncoding, v)
+	}
+
+	d := &decoder{data: data[len(seededMagic)+1:]}
+	seed := d.next(seedSize)
+	metaBytes := d.bytes()
+	b := d.poly()
+	if err := d.close(); err != nil {
+		return nil, err
+	}
+	if b == nil || b.N() != params.N() || b.Level() > params.MaxLevel() {
+		return nil, fmt.Errorf("%w: invalid ciphertext", ErrInvalidEncoding)
+	}
+
+	ct = &rlwe.Ciphertext{Value: []*ring.Poly{b, params.RingQ().NewPolyLvl(b.Level())}}
+	if err := ct.MetaData.UnmarshalBinary(metaBytes); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEncoding, err)
+	}
+	if !ct.IsNTT {
+		return nil, fmt.Errorf("%w: seeded ciphertext should be in NTT form", ErrInvalidEncoding)
+	}
+
+	ringQ := ringqp.Ring{RingQ: params.RingQ()}
+	if err := expandSeed(ringQ, b.Level(), -1, seed, ringqp.Poly{Q: ct.Value[1]}); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+// MarshalSeededBundle encodes PublicKeyBundle of this context in the seeded format,
+// where the relinearization key and rotation keys are about half the size of PublicKeyBundle.MarshalBinary.
+// The public key is encoded as is.
+// Keys of this context are reseeded in place, so PublicKeyBundle should not have been sent before.
+// Encoding them again gives the same bytes.
+// The server decodes it with PublicKeyBundle.UnmarshalBinary.
+func (ctx *ClientContext) MarshalSeededBundle() ([]byte, error) {
+	params := ctx.Parameters
+	ringQP := *params.RingQP()
+	levelQ, levelP := params.QCount()-1, params.PCount()-1
+	sk := ctx.SecretKey.Value
+
+	buf := new(bytes.Buffer)
+	if err := writeBundleHeader(buf, params, ctx.PublicKey); err != nil {
+		return nil, err
+	}
+
+	// Relinearization keys are encrypted under sk.
+	if ctx.RelinearizationKey != nil {
+		section := new(bytes.Buffer)
+		writeUint64(section, uint64(len(ctx.RelinearizationKey.Keys)))
+		for _, swk := range ctx.RelinearizationKey.Keys {
+			if err := writeSeededSwitchingKey(section, ringQP, swk, sk); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteByte(tagSeededRelinearizationKey)
+		writeBytes(buf, section.Bytes())
+	}
+
+	// Rotation keys are encrypted under the automorphism of sk by the inverse Galois element,
+	// as in Lattigo.
+	if ctx.RotationKeys != nil {
+		galEls := make([]uint64, 0, len(ctx.RotationKeys.Keys))
+		for galEl := range ctx.RotationKeys.Keys {
+			galEls = append(galEls, galEl)
+		}
+		sort.Slice(galEls, func(i, j int) bool { return galEls[i] < galEls[j] })
+
+		section := new(bytes.Buffer)
+		writeUint64(section, uint64(len(galEls)))
+		skOut := ringQP.NewPolyLvl(levelQ, levelP)
+		for _, galEl := range galEls {
+			index := params.RingQ().PermuteNTTIndex(params.InverseGaloisElement(galEl))
+			ringQP.PermuteNTTWithIndexLvl(levelQ, levelP, sk, index, skOut)
+
+			writeUint64(section, galEl)
+			if err := writeSeededSwitchingKey(section, ringQP, ctx.RotationKeys.Keys[galEl], skOut); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteByte(tagSeededRotationKeys)
+		writeBytes(buf, section.Bytes())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeSeededSwitchingKey reseeds swk encrypted under sk with the seed derived from it,
+// and writes it to buf in the seeded format.
+func writeSeededSwitchingKey(buf *bytes.Buffer, ringQP ringqp.Ring, swk *rlwe.SwitchingKey, sk ringqp.Poly) error {
+	levelQ, levelP := swk.LevelQ(), swk.LevelP()
+	var values [][2]ringqp.Poly
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			values = append(values, [2]ringqp.Poly{swk.Value[i][j].Value[0], swk.Value[i][j].Value[1]})
+		}
+	}
+	seed, err := derivedSeed(ringQP, levelQ, levelP, sk, values)
+	if err != nil {
+		return err
+	}
+
+	sampler, err := newSeededSampler(ringQP, seed)
+	if err != nil {
+		return err
+	}
+	a := ringQP.NewPolyLvl(levelQ, levelP)
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			sampler.ReadLvl(levelQ, levelP, a)
+			reseedWith(ringQP, levelQ, levelP, swk.Value[i][j].Value[0], swk.Value[i][j].Value[1], sk, a)
+		}
+	}
+
+	return encodeSeededSwitchingKey(buf, swk, seed)
+}
+
+// encodeSeededSwitchingKey writes swk with seed to buf, omitting the uniformly random part.
+// swk should already be generated from seed.
+func encodeSeededSwitchingKey(buf *bytes.Buffer, swk *rlwe.SwitchingKey, seed []byte) error {
+	buf.Write(seed)
+	writeUint64(buf, uint64(swk.LevelQ()))
+	writeUint64(buf, uint64(swk.LevelP()+1))
+	writeUint64(buf, uint64(len(swk.Value)))
+	writeUint64(buf, uint64(len(swk.Value[0])))
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			if err := writePoly(buf, swk.Value[i][j].Value[0].Q); err != nil {
+				return err
+			}
+			if err := writePoly(buf, swk.Value[i][j].Value[0].P); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seededSwitchingKey reads switching key written by encodeSeededSwitchingKey,
+// expanding its seed with params.
+func (d *decoder) seededSwitchingKey(params ckks.Parameters) *rlwe.SwitchingKey {
+	seed := d.next(seedSize)
+	levelQ := int(d.uint64())
+	levelP := int(d.uint64()) - 1
+	decompRNS := int(d.uint64())
+	decompPw2 := int(d.uint64())
+	if d.err != nil {
+		return nil
+	}
+	if levelQ < 0 || levelQ >= params.QCount() || levelP < -1 || levelP >= params.PCount() ||
+		decompRNS != params.DecompRNS(levelQ, levelP) || decompPw2 != params.DecompPw2(levelQ, levelP) {
+		d.err = fmt.Errorf("%w: invalid switching key dimension", ErrInvalidEncoding)
+		return nil
+	}
+
+	ringQP := *params.RingQP()
+	sampler, err := newSeededSampler(ringQP, seed)
+	if err != nil {
+		d.err = err
+		return nil
+	}
+
+	swk := rlwe.NewSwitchingKey(params.Parameters, levelQ, levelP)
+	for i := range swk.Value {
+		for j := range swk.Value[i] {
+			q, p := d.poly(), d.poly()
+			if d.err != nil {
+				return nil
+			}
+			if q == nil || q.N() != params.N() || q.Level() != levelQ ||
+				(levelP >= 0 && (p == nil || p.N() != params.N() || p.Level() != levelP)) {
+				d.err = fmt.Errorf("%w: invalid switching key", ErrInvalidEncoding)
+				return nil
+			}
+			swk.Value[i][j].Value[0] = ringqp.Poly{Q: q, P: p}
+			sampler.ReadLvl(levelQ, levelP, swk.Value[i][j].Value[1])
+		}
+	}
+	return swk
+}
+
+// seededRelinearizationKey reads the relinearization key section of MarshalSeededBundle.
+func (d *decoder) seededRelinearizationKey(params ckks.Parameters) *rlwe.RelinearizationKey {
+	n := d.uint64()
+	if n > relinearizationDegree {
+		d.err = fmt.Errorf("%w: relinearization key of degree %d", ErrInvalidEncoding, n)
+		return nil
+	}
+
+	rlk := &rlwe.RelinearizationKey{Keys: make([]*rlwe.SwitchingKey, n)}
+	for i := range rlk.Keys {
+		rlk.Keys[i] = d.seededSwitchingKey(params)
+	}
+	if d.err != nil {
+		return nil
+	}
+	return rlk
+}
+
+// seededRotationKeys reads the rotation keys section of MarshalSeededBundle.
+func (d *decoder) seededRotationKeys(params ckks.Parameters) *rlwe.RotationKeySet {
+	n := d.uint64()
+	if d.err != nil {
+		return nil
+	}
+
+	rtks := &rlwe.RotationKeySet{Keys: make(map[uint64]*rlwe.SwitchingKey)}
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		galEl := d.uint64()
+		rtks.Keys[galEl] = d.seededSwitchingKey(params)
+	}
+	if d.err != nil {
+		return nil
+	}
+	return rtks
+}
+
+// derivedSeed returns the seed derived from b + a*sk of every (b, a) in values encrypted under sk.
+// b + a*sk is the message with the error, which is secret and does not change by reseeding.
+// Polynomials are in NTT form, and sk is in Montgomery form.
+func derivedSeed(ringQP ringqp.Ring, levelQ, levelP int, sk ringqp.Poly, values [][2]ringqp.Poly) ([]byte, error) {
+	h := sha256.New()
+	buf := new(bytes.Buffer)
+	u := ringQP.NewPolyLvl(levelQ, levelP)
+	for _, v := range values {
+		ringQP.MulCoeffsMontgomeryLvl(levelQ, levelP, v[1], sk, u)
+		ringQP.AddLvl(levelQ, levelP, u, v[0], u)
+
+		buf.Reset()
+		if err := writePoly(buf, u.Q); err != nil {
+			return nil, err
+		}
+		if err := writePoly(buf, u.P); err != nil {
+			return nil, err
+		}
+		h.Write(buf.Bytes())
+	}
+	return h.Sum(nil)[:seedSize], nil
+}
+
+// newSeededSampler returns the uniform sampler generating from seed.
+func newSeededSampler(ringQP ringqp.Ring, seed []byte) (ringqp.UniformSampler, error) {
+	prng, err := utils.NewKeyedPRNG(seed)
+	if err != nil {
+		return ringqp.UniformSampler{}, err
+	}
+	return ringqp.NewUniformSampler(prng, ringQP), nil
+}
+
+// expandSeed writes the uniformly random part generated from seed to a.
+func expandSeed(ringQP ringqp.Ring, levelQ, levelP int, seed []byte, a ringqp.Poly) error {
+	sampler, err := newSeededSampler(ringQP, seed)
+	if err != nil {
+		return err
+	}
+	sampler.ReadLvl(levelQ, levelP, a)
+	return nil
+}
+
+// reseed replaces a of (b, a) encrypted under sk with the one generated from seed.
+func reseed(ringQP ringqp.Ring, levelQ, levelP int, b, a, sk ringqp.Poly, seed []byte) error {
+	aSeeded := ringQP.NewPolyLvl(levelQ, levelP)
+	if err := expandSeed(ringQP, levelQ, levelP, seed, aSeeded); err != nil {
+		return err
+	}
+	reseedWith(ringQP, levelQ, levelP, b, a, sk, aSeeded)
+	return nil
+}
+
+// reseedWith replaces a of (b, a) encrypted under sk with aSeeded, and adds (a - aSeeded)*sk to b.
+// Polynomials are in NTT form, and sk is in Montgomery form.
+func reseedWith(ringQP ringqp.Ring, levelQ, levelP int, b, a, sk, aSeeded ringqp.Poly) {
+	ringQP.SubLvl(levelQ, levelP, a, aSeeded, a)
+	ringQP.MulCoeffsMontgomeryAndAddLvl(levelQ, levelP, a, sk, b)
+	ringQP.CopyLvl(levelQ, levelP, aSeeded, a)
+}
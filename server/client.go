@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"henn"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// Client talks to Server over HTTP.
+// It only handles public data: keys should be generated by henn.ClientContext,
+// and the PublicKeyBundle should be registered with Register before Infer.
+type Client struct {
+	// URL is the base URL of the server, such as "http://localhost:8080".
+	URL string
+	// HTTPClient is used to send requests.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Session is the ID of the session, set by Register.
+	Session string
+}
+
+// NewClient returns a new Client talking to the server at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{URL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Metadata fetches the Metadata of the model.
+func (c *Client) Metadata(ctx context.Context) (Metadata, error) {
+	var m Metadata
+	body, err := c.do(ctx, http.MethodGet, "/metadata", "", nil)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, fmt.Errorf("%w: %v", henn.ErrInvalidEncoding, err)
+	}
+	return m, nil
+}
+
+// Register sends keys to the server, and stores the returned session ID in Session.
+func (c *Client) Register(ctx context.Context, keys *henn.PublicKeyBundle) (string, error) {
+	data, err := keys.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return c.RegisterSeeded(ctx, data)
+}
+
+// RegisterSeeded is Register with keys encoded by henn.ClientContext.MarshalSeededBundle,
+// which is about half the size.
+func (c *Client) RegisterSeeded(ctx context.Context, data []byte) (string, error) {
+	body, err := c.do(ctx, http.MethodPost, "/sessions", "application/octet-stream", data)
+	if err != nil {
+		return "", err
+	}
+
+	var s Session
+	if err := json.Unmarshal(body, &s); err != nil {
+		return "", fmt.Errorf("%w: %v", henn.ErrInvalidEncoding, err)
+	}
+	c.Session = s.ID
+	return s.ID, nil
+}
+
+// Infer sends ct to the server, and returns the encrypted output.
+func (c *Client) Infer(ctx context.Context, ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	data, err := ct.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return c.infer(ctx, "application/octet-stream", data)
+}
+
+// InferSeeded is Infer with the ciphertext encoded by henn.ClientContext.MarshalSeededCiphertext,
+// which is about half the size.
+// The output is not seeded, since it is not a fresh encryption.
+func (c *Client) InferSeeded(ctx context.Context, data []byte) (*rlwe.Ciphertext, error) {
+	return c.infer(ctx, SeededContentType, data)
+}
+
+// infer sends data of contentType to the infer endpoint of the session.
+func (c *Client) infer(ctx context.Context, contentType string, data []byte) (*rlwe.Ciphertext, error) {
+	if c.Session == "" {
+		return nil, fmt.Errorf("%w: not registered", ErrUnknownSession)
+	}
+
+	body, err := c.do(ctx, http.MethodPost, "/sessions/"+url.PathEscape(c.Session)+"/infer", contentType, data)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalCiphertext(body)
+}
+
+// do sends the request to path with body of contentType, and returns the response body.
+// Responses other than 200 are returned as errors.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body []byte) ([]byte, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return respBody, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSession, strings.TrimSpace(string(respBody)))
+	}
+	return nil, fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+}
@@ -0,0 +1,268 @@
+// Package server serves encrypted inference of henn.HENeuralNet over HTTP.
+//
+// The server never sees the secret key of its clients.
+// A client first fetches Metadata to learn the parameters, rotations and input of the model,
+// generates keys accordingly, and registers its PublicKeyBundle to obtain a session.
+// Ciphertexts sent to the session are evaluated with the keys of that session.
+// One model is shared by all sessions, and keys are held in SessionStore.
+//
+// Endpoints are:
+//
+//	GET  /metadata               returns Metadata in JSON.
+//	POST /sessions               takes serialized PublicKeyBundle, returns Session in JSON.
+//	POST /sessions/{id}/infer    takes serialized ciphertext, returns serialized output ciphertext.
+//
+// To save upload bandwidth, PublicKeyBundle may be in the seeded format of henn.ClientContext.MarshalSeededBundle,
+// and ciphertexts may be in the seeded format of henn.ClientContext.MarshalSeededCiphertext
+// with Content-Type SeededContentType. Seeds are expanded by the server.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"henn"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/tuneinsight/lattigo/v4/ckks"
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// DefaultMaxBodySize is the default maximum size of request bodies.
+// It should be large enough to hold rotation keys of the model.
+const DefaultMaxBodySize = 1 << 30
+
+// SeededContentType is the Content-Type of ciphertexts in the seeded format.
+const SeededContentType = "application/x-henn-seeded"
+
+// ErrUnknownSession is returned when the session does not exist.
+var ErrUnknownSession = errors.New("unknown session")
+
+// Metadata describes the model served by Server.
+// It is everything the client needs to generate keys and encrypt inputs,
+// without knowing the model itself.
+type Metadata struct {
+	Parameters ckks.Parameters
+	// Rotations are the rotations that registered keys should have.
+	Rotations []int
+	// Input describes how the input should be encrypted.
+	Input henn.InputSpec
+}
+
+// Session is returned when the keys are registered.
+type Session struct {
+	ID string
+}
+
+// Server is an http.Handler that serves encrypted inference of a model.
+// The model is shared by all clients, and keys of each client are held in Sessions.
+type Server struct {
+	// MaxBodySize is the maximum size of request bodies.
+	// If MaxBodySize <= 0, DefaultMaxBodySize is used.
+	MaxBodySize int64
+
+	// Sessions stores the keys of registered clients.
+	// Set its MaxBytes and SpillDir to bound the memory used by keys.
+	Sessions *SessionStore
+
+	model *henn.HENeuralNet
+	mux   *http.ServeMux
+}
+
+// NewServer returns a new Server which serves model.
+// model does not need to be initialized, and should not be modified after this.
+func NewServer(model *henn.HENeuralNet) *Server {
+	s := &Server{
+		Sessions: NewSessionStore(model),
+		model:    model,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/metadata", s.handleMetadata)
+	s.mux.HandleFunc("/sessions", s.handleRegister)
+	s.mux.HandleFunc("/sessions/", s.handleInfer)
+	return s
+}
+
+// Metadata returns the Metadata of the model.
+func (s *Server) Metadata() Metadata {
+	return Metadata{
+		Parameters: s.model.Parameters,
+		Rotations:  s.model.Rotations(),
+		Input:      s.model.Input,
+	}
+}
+
+// Register stores keys in Sessions, and returns the ID of the new session.
+func (s *Server) Register(keys *henn.PublicKeyBundle) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+
+	if err := s.Sessions.Put(id, keys); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Infer evaluates the model with the keys of session id.
+func (s *Server) Infer(id string, ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+	ec, err := s.Sessions.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.model.InferWith(ec, ct)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleMetadata serves GET /metadata.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.Metadata())
+}
+
+// handleRegister serves POST /sessions.
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := s.readBody(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keys := new(henn.PublicKeyBundle)
+	if err := keys.UnmarshalBinary(data); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := s.Register(keys)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, Session{ID: id})
+}
+
+// handleInfer serves POST /sessions/{id}/infer.
+func (s *Server) handleInfer(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if !ok || id == "" || action != "infer" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := s.readBody(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var ct *rlwe.Ciphertext
+	if r.Header.Get("Content-Type") == SeededContentType {
+		ct, err = henn.UnmarshalSeededCiphertext(s.model.Parameters, data)
+	} else {
+		ct, err = unmarshalCiphertext(data)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctOut, err := s.Infer(id, ct)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	out, err := ctOut.MarshalBinary()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(out)
+}
+
+// readBody reads the body of r, up to MaxBodySize.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	limit := s.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, fmt.Errorf("%w: body larger than %d bytes", henn.ErrInvalidEncoding, limit)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmarshalCiphertext decodes data to ciphertext.
+// Lattigo panics on malformed data, so it is recovered as ErrInvalidEncoding.
+func unmarshalCiphertext(data []byte) (ct *rlwe.Ciphertext, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ct, err = nil, fmt.Errorf("%w: %v", henn.ErrInvalidEncoding, r)
+		}
+	}()
+
+	ct = new(rlwe.Ciphertext)
+	if err := ct.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", henn.ErrInvalidEncoding, err)
+	}
+	return ct, nil
+}
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as the response, with the status code determined by its kind.
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), statusCode(err))
+}
+
+// statusCode returns the HTTP status code of err.
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownSession):
+		return http.StatusNotFound
+	case errors.Is(err, henn.ErrInvalidEncoding),
+		errors.Is(err, henn.ErrInvalidKeys),
+		errors.Is(err, henn.ErrParametersMismatch),
+		errors.Is(err, henn.ErrShapeMismatch),
+		errors.Is(err, henn.ErrInsufficientLevels):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"henn"
+	"henn/internal/testparams"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/tuneinsight/lattigo/v4/rlwe"
+)
+
+// testModel returns a small model for tests, and its reference.
+func testModel(t *testing.T) (*henn.HENeuralNet, *henn.PlainNeuralNet) {
+	params := testparams.Small(t)
+
+	r := rand.New(rand.NewSource(0))
+	ll := henn.LinearLayer{Weights: make([][]float64, 10), Bias: make([]float64, 10)}
+	for i := range ll.Weights {
+		ll.Weights[i] = make([]float64, 20)
+		for j := range ll.Weights[i] {
+			ll.Weights[i][j] = r.Float64() - 0.5
+		}
+		ll.Bias[i] = r.Float64() - 0.5
+	}
+	layers := []henn.Layer{ll, henn.Square()}
+
+	model, err := henn.NewHENeuralNet(params, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainNN, err := henn.NewPlainNeuralNet(params.Slots(), layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model, plainNN
+}
+
+// checkInfer encrypts a random input with ctx, evaluates it with infer, and compares with plainNN.
+func checkInfer(t *testing.T, ctx *henn.ClientContext, input henn.InputSpec, plainNN *henn.PlainNeuralNet, infer func(*rlwe.Ciphertext) (*rlwe.Ciphertext, error)) {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(1))
+	msg := make([]float64, 20)
+	for i := range msg {
+		msg[i] = r.Float64()
+	}
+	ct, err := ctx.EncryptInput(input, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctOut, err := infer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ctx.DecryptFloats(ctOut, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := plainNN.Infer(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-3 {
+			t.Fatalf("output %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	model, plainNN := testModel(t)
+	params := model.Parameters
+
+	ts := httptest.NewServer(NewServer(model))
+	defer ts.Close()
+
+	c := NewClient(ts.URL)
+	c.HTTPClient = ts.Client()
+	bg := context.Background()
+
+	meta, err := c.Metadata(bg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Parameters.Equals(params) {
+		t.Fatal("parameters mismatch")
+	}
+	if !reflect.DeepEqual(meta.Input, model.Input) {
+		t.Fatalf("want input %v, got %v", model.Input, meta.Input)
+	}
+
+	// Client only uses Metadata from here.
+	ctx := henn.NewClientContext(meta.Parameters)
+	ctx.GenRotationKeys(meta.Rotations)
+
+	t.Run("Infer", func(t *testing.T) {
+		if _, err := c.Register(bg, ctx.PublicKeyBundle()); err != nil {
+			t.Fatal(err)
+		}
+
+		checkInfer(t, ctx, meta.Input, plainNN, func(ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+			return c.Infer(bg, ct)
+		})
+	})
+
+	t.Run("Seeded", func(t *testing.T) {
+		ctx := henn.NewClientContext(meta.Parameters)
+		ctx.GenRotationKeys(meta.Rotations)
+		keys, err := ctx.MarshalSeededBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewClient(ts.URL)
+		if _, err := c.RegisterSeeded(bg, keys); err != nil {
+			t.Fatal(err)
+		}
+		checkInfer(t, ctx, meta.Input, plainNN, func(ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+			data, err := ctx.MarshalSeededCiphertext(ct)
+			if err != nil {
+				return nil, err
+			}
+			return c.InferSeeded(bg, data)
+		})
+	})
+
+	t.Run("UnknownSession", func(t *testing.T) {
+		ct, err := ctx.EncryptFloats([]float64{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient(ts.URL)
+		c.Session = "unknown"
+		if _, err := c.Infer(bg, ct); !errors.Is(err, ErrUnknownSession) {
+			t.Fatalf("want ErrUnknownSession, got %v", err)
+		}
+	})
+
+	t.Run("MissingRotations", func(t *testing.T) {
+		ctx := henn.NewClientContext(meta.Parameters)
+		c := NewClient(ts.URL)
+		if _, err := c.Register(bg, ctx.PublicKeyBundle()); err == nil {
+			t.Fatal("want error for missing rotation keys")
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, path := range []string{"/sessions", "/sessions/" + c.Session + "/infer"} {
+			resp, err := http.Post(ts.URL+path, "application/octet-stream", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("%s: want status %d, got %d", path, http.StatusBadRequest, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	model, plainNN := testModel(t)
+
+	ctxs := make([]*henn.ClientContext, 3)
+	for i := range ctxs {
+		ctxs[i] = henn.NewClientContext(model.Parameters)
+		ctxs[i].GenRotationKeys(model.Rotations())
+	}
+	ec, err := model.NewEvaluationContext(ctxs[0].PublicKeyBundle())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(ec.Size())
+
+	for _, spill := range []bool{false, true} {
+		name := "Memory"
+		if spill {
+			name = "Spill"
+		}
+		t.Run(name, func(t *testing.T) {
+			// Only two sessions fit in memory.
+			store := NewSessionStore(model)
+			store.MaxBytes = 2*size + size/2
+			if spill {
+				store.SpillDir = t.TempDir()
+			}
+
+			for i, id := range []string{"a", "b"} {
+				if err := store.Put(id, ctxs[i].PublicKeyBundle()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a is used more recently than b, so b is evicted.
+			if _, err := store.Get("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Put("c", ctxs[2].PublicKeyBundle()); err != nil {
+				t.Fatal(err)
+			}
+			if store.Len() != 2 || store.Bytes() != 2*size {
+				t.Fatalf("want 2 sessions of %d bytes, got %d sessions of %d bytes", 2*size, store.Len(), store.Bytes())
+			}
+
+			ec, err := store.Get("b")
+			if !spill {
+				if !errors.Is(err, ErrUnknownSession) {
+					t.Fatalf("want ErrUnknownSession, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkInfer(t, ctxs[1], model.Input, plainNN, func(ct *rlwe.Ciphertext) (*rlwe.Ciphertext, error) {
+				return model.InferWith(ec, ct)
+			})
+
+			if err := store.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.Get("b"); !errors.Is(err, ErrUnknownSession) {
+				t.Fatalf("want ErrUnknownSession, got %v", err)
+			}
+		})
+	}
+
+	t.Run("TooLarge", func(t *testing.T) {
+		store := NewSessionStore(model)
+		store.MaxBytes = size - 1
+		if err := store.Put("a", ctxs[0].PublicKeyBundle()); !errors.Is(err, henn.ErrInvalidKeys) {
+			t.Fatalf("want ErrInvalidKeys, got %v", err)
+		}
+	})
+
+	t.Run("InvalidID", func(t *testing.T) {
+		store := NewSessionStore(model)
+		store.SpillDir = t.TempDir()
+		if err := store.Put("../a", ctxs[0].PublicKeyBundle()); err == nil {
+			t.Fatal("want error for invalid session id")
+		}
+		if _, err := store.Get("../a"); !errors.Is(err, ErrUnknownSession) {
+			t.Fatalf("want ErrUnknownSession, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"henn"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionStore stores the keys of clients keyed by session ID,
+// so that one model can serve many clients.
+// Every session holds a henn.EvaluationContext, which shares the encoded layers of the model.
+//
+// Sizes of evaluation keys are accounted, and when the total exceeds MaxBytes,
+// least recently used sessions are evicted.
+// If SpillDir is set, keys are also written to disk,
+// and evicted sessions are restored from there when used again.
+//
+// SessionStore is safe for concurrent use.
+type SessionStore struct {
+	// MaxBytes is the maximum total size of evaluation keys held in memory.
+	// If MaxBytes <= 0, sessions are never evicted.
+	MaxBytes int64
+	// SpillDir is the directory where keys are written.
+	// If empty, evicted sessions are lost.
+	SpillDir string
+
+	model *henn.HENeuralNet
+
+	mu       sync.Mutex
+	lru      *list.List // of *storeEntry, most recently used first.
+	sessions map[string]*list.Element
+	bytes    int64
+}
+
+// storeEntry is a session in SessionStore.
+type storeEntry struct {
+	id   string
+	ec   *henn.EvaluationContext
+	size int64
+}
+
+// NewSessionStore returns an empty SessionStore for model.
+// model should not be modified after this.
+func NewSessionStore(model *henn.HENeuralNet) *SessionStore {
+	return &SessionStore{
+		model:    model,
+		lru:      list.New(),
+		sessions: make(map[string]*list.Element),
+	}
+}
+
+// Put creates the session id with keys, replacing the existing one.
+// It returns error if keys are invalid for the model, or larger than MaxBytes.
+func (s *SessionStore) Put(id string, keys *henn.PublicKeyBundle) error {
+	if !validSessionID(id) {
+		return fmt.Errorf("invalid session id %q", id)
+	}
+
+	ec, err := s.model.NewEvaluationContext(keys)
+	if err != nil {
+		return err
+	}
+	size := int64(ec.Size())
+	if s.MaxBytes > 0 && size > s.MaxBytes {
+		return fmt.Errorf("%w: keys of %d bytes exceed the store limit of %d bytes", henn.ErrInvalidKeys, size, s.MaxBytes)
+	}
+
+	if s.SpillDir != "" {
+		if err := s.spill(id, keys); err != nil {
+			return err
+		}
+	}
+
+	s.insert(&storeEntry{id: id, ec: ec, size: size})
+	return nil
+}
+
+// Get returns the EvaluationContext of session id.
+// If the session was evicted, it is restored from SpillDir.
+func (s *SessionStore) Get(id string) (*henn.EvaluationContext, error) {
+	s.mu.Lock()
+	if e, ok := s.sessions[id]; ok {
+		s.lru.MoveToFront(e)
+		s.mu.Unlock()
+		return e.Value.(*storeEntry).ec, nil
+	}
+	s.mu.Unlock()
+
+	if s.SpillDir == "" || !validSessionID(id) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSession, id)
+	}
+
+	keys, err := s.restore(id)
+	if err != nil {
+		return nil, err
+	}
+	ec, err := s.model.NewEvaluationContext(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	s.insert(&storeEntry{id: id, ec: ec, size: int64(ec.Size())})
+	return ec, nil
+}
+
+// Delete removes session id, including its keys in SpillDir.
+func (s *SessionStore) Delete(id string) error {
+	s.mu.Lock()
+	if e, ok := s.sessions[id]; ok {
+		s.remove(e)
+	}
+	s.mu.Unlock()
+
+	if s.SpillDir == "" || !validSessionID(id) {
+		return nil
+	}
+	if err := os.Remove(s.spillPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Len returns the number of sessions held in memory.
+func (s *SessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Bytes returns the total size of evaluation keys held in memory.
+func (s *SessionStore) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// insert adds e as the most recently used session,
+// and evicts least recently used sessions until the total size fits in MaxBytes.
+func (s *SessionStore) insert(e *storeEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.sessions[e.id]; ok {
+		s.remove(old)
+	}
+	s.sessions[e.id] = s.lru.PushFront(e)
+	s.bytes += e.size
+
+	// e itself is never evicted, since it fits in MaxBytes.
+	for s.MaxBytes > 0 && s.bytes > s.MaxBytes && s.lru.Len() > 1 {
+		s.remove(s.lru.Back())
+	}
+}
+
+// remove removes e from memory.
+// s.mu should be held.
+func (s *SessionStore) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*storeEntry)
+	delete(s.sessions, entry.id)
+	s.bytes -= entry.size
+}
+
+// spillPath returns the path of the keys of session id in SpillDir.
+func (s *SessionStore) spillPath(id string) string {
+	return filepath.Join(s.SpillDir, id+".keys")
+}
+
+// spill writes keys of session id to SpillDir.
+// Keys are written to a temporary file first, so that a partially written file is never restored.
+func (s *SessionStore) spill(id string, keys *henn.PublicKeyBundle) error {
+	data, err := keys.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(s.SpillDir, id+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.spillPath(id))
+}
+
+// restore reads keys of session id from SpillDir.
+func (s *SessionStore) restore(id string) (*henn.PublicKeyBundle, error) {
+	data, err := os.ReadFile(s.spillPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSession, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := new(henn.PublicKeyBundle)
+	if err := keys.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// validSessionID checks if id is safe to use as a file name,
+// which consists of at most 64 letters, digits, '-' and '_'.
+func validSessionID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}